@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/app"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/config"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/service"
+)
+
+// adminUsage describes the admin commands
+const adminUsage = `Usage: gophermart admin [flags] <command> <args>
+
+Commands:
+  set-role <login> <role>   change the role of a user (user, support, admin)
+  disable <login>           disable a user account
+  enable <login>            enable a disabled user account
+  requeue <order>           reset a stuck order so that the worker checks it again
+`
+
+// adminCommand is an administrative action on the database
+type adminCommand struct {
+	args int
+	run  func(ctx context.Context, a *app.App, args []string) (userID int64, err error)
+}
+
+var adminCommands = map[string]adminCommand{
+	"set-role": {args: 2, run: adminSetRole},
+	"disable":  {args: 1, run: adminSetDisabled(true)},
+	"enable":   {args: 1, run: adminSetDisabled(false)},
+	"requeue":  {args: 1, run: adminRequeue},
+}
+
+// runAdmin runs an admin command and records it in the audit log of the
+// affected user. It returns the process exit code.
+func runAdmin(args []string) int {
+	cfg, rest, err := config.LoadArgs(config.CommandDatabase, args)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprint(os.Stderr, adminUsage)
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
+		return 1
+	}
+
+	if len(rest) == 0 {
+		fmt.Fprint(os.Stderr, adminUsage)
+		return 2
+	}
+	cmd, ok := adminCommands[rest[0]]
+	if !ok || len(rest)-1 != cmd.args {
+		fmt.Fprint(os.Stderr, adminUsage)
+		return 2
+	}
+
+	a, err := app.New(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Setup error: %v\n", err)
+		return 1
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	defer a.Close(ctx)
+
+	if err := a.Repo.InitDB(cfg.DatabaseURI); err != nil {
+		fmt.Fprintf(os.Stderr, "Database error: %v\n", err)
+		return 1
+	}
+
+	userID, err := cmd.run(ctx, a, rest[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", rest[0], err)
+		return 1
+	}
+
+	details := map[string]string{
+		"source": "cli",
+		"action": rest[0],
+	}
+	for i, arg := range rest[1:] {
+		details[fmt.Sprintf("arg%d", i+1)] = arg
+	}
+	if u, err := user.Current(); err == nil {
+		details["os_user"] = u.Username
+	}
+	service.NewAuditService(a.Repo).Record(ctx, models.AuditEvent{
+		UserID:  userID,
+		Type:    models.EventAdminAction,
+		Details: details,
+	})
+
+	fmt.Println("OK")
+	return 0
+}
+
+// adminFindUser loads a user by login
+func adminFindUser(ctx context.Context, a *app.App, login string) (*models.User, error) {
+	u, err := a.Repo.GetUserByLogin(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, fmt.Errorf("user %q not found", login)
+	}
+	return u, nil
+}
+
+// adminSetRole changes the role of a user
+func adminSetRole(ctx context.Context, a *app.App, args []string) (int64, error) {
+	if !models.IsValidRole(args[1]) {
+		return 0, fmt.Errorf("unknown role %q", args[1])
+	}
+
+	u, err := adminFindUser(ctx, a, args[0])
+	if err != nil {
+		return 0, err
+	}
+	return u.ID, a.Repo.SetUserRole(ctx, u.ID, args[1])
+}
+
+// adminSetDisabled disables or enables a user account
+func adminSetDisabled(disabled bool) func(context.Context, *app.App, []string) (int64, error) {
+	return func(ctx context.Context, a *app.App, args []string) (int64, error) {
+		u, err := adminFindUser(ctx, a, args[0])
+		if err != nil {
+			return 0, err
+		}
+		return u.ID, a.Repo.SetUserDisabled(ctx, u.ID, disabled)
+	}
+}
+
+// adminRequeue resets an unprocessed order to NEW
+func adminRequeue(ctx context.Context, a *app.App, args []string) (int64, error) {
+	order, err := a.Repo.GetOrderByNumber(ctx, args[0])
+	if err != nil {
+		return 0, err
+	}
+	if order == nil {
+		return 0, fmt.Errorf("order %s not found", args[0])
+	}
+
+	requeued, err := a.Repo.RequeueOrder(ctx, order.Number)
+	if err != nil {
+		return 0, err
+	}
+	if !requeued {
+		return 0, errors.New("order is already processed")
+	}
+	return order.UserID, nil
+}
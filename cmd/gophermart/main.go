@@ -2,41 +2,192 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
-	"time"
 
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/app"
 	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/config"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
 	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/server"
+	"golang.org/x/exp/slog"
 )
 
+// usage describes the subcommands
+const usage = `Usage: gophermart [command] [flags]
+
+Commands:
+  all            run the HTTP API and the order processor (default)
+  serve          run the HTTP API only
+  worker         run the order processor only
+  migrate        update the database schema and exit
+  admin          run an administrative command, see "gophermart admin -h"
+  config print   print the effective configuration
+`
+
 func main() {
-	// Load configuration
-	cfg := config.NewConfig()
+	args := os.Args[1:]
+
+	// The first argument selects the command unless it is a flag
+	command := "all"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "all":
+		run(args, server.Mode{API: true, Worker: true})
+	case "serve":
+		run(args, server.Mode{API: true})
+	case "worker":
+		run(args, server.Mode{Worker: true})
+	case "migrate":
+		migrate(args)
+	case "admin":
+		os.Exit(runAdmin(args))
+	case "config":
+		// gophermart config print [flags]
+		if len(args) > 0 && args[0] == "print" {
+			os.Exit(printConfig(args[1:]))
+		}
+		fallthrough
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// loadConfig loads the configuration for the command and sets up logging,
+// exiting on errors
+func loadConfig(cmd config.Command, args []string) *config.Config {
+	cfg, err := config.Load(cmd, args)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+
+	// Switch to structured logging
+	if err := logging.Setup(cfg.LogLevel); err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+
+	return cfg
+}
+
+// run runs the server in the given mode until SIGINT or SIGTERM
+func run(args []string, mode server.Mode) {
+	cfg := loadConfig(config.CommandRun, args)
+
+	a, err := app.New(cfg)
+	if err != nil {
+		fatal("Server setup error", err)
+	}
 
 	// Create and run server
-	srv := server.NewServer(cfg)
+	srv, err := server.NewServer(a, mode)
+	if err != nil {
+		fatal("Server setup error", err)
+	}
 	go func() {
-		if err := srv.Run(); err != nil {
-			log.Fatalf("Server error: %v", err)
+		if err := srv.Run(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("Server error", err)
 		}
 	}()
 
-	// Wait for termination signal
+	// Wait for termination signal, reloading the configuration on SIGHUP
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := <-quit; sig == syscall.SIGHUP; sig = <-quit {
+		reloadConfig(srv, args)
+	}
 
 	// Graceful shutdown
-	log.Println("Shutting down server...")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	slog.Info("Shutting down server")
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
 	defer cancel()
 
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Server shutdown error: %v", err)
+		fatal("Server shutdown error", err)
+	}
+
+	slog.Info("Server stopped")
+}
+
+// migrate updates the database schema regardless of auto_migrate
+func migrate(args []string) {
+	cfg := loadConfig(config.CommandDatabase, args)
+
+	a, err := app.New(cfg)
+	if err != nil {
+		fatal("Setup error", err)
+	}
+	if err := a.Repo.InitDB(cfg.DatabaseURI); err != nil {
+		fatal("Database error", err)
+	}
+	if err := a.Migrate(); err != nil {
+		fatal("Migration error", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := a.Close(ctx); err != nil {
+		fatal("Shutdown error", err)
+	}
+
+	slog.Info("Database schema is up to date")
+}
+
+// fatal logs the error and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// reloadConfig re-reads the configuration and applies what can be changed
+// at runtime. An invalid configuration is rejected as a whole.
+func reloadConfig(srv *server.Server, args []string) {
+	slog.Info("Reloading configuration")
+	cfg, err := config.Load(config.CommandRun, args)
+	if err != nil {
+		slog.Error("Config reload failed, keeping current settings", "error", err)
+		return
+	}
+	srv.Reload(cfg)
+}
+
+// printConfig prints the effective configuration with secrets redacted and
+// reports validation errors. It returns the process exit code.
+func printConfig(args []string) int {
+	cfg, err := config.Load(config.CommandPrint, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+
+	var verr config.ValidationError
+	if err != nil && !errors.As(err, &verr) {
+		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
+		return 1
+	}
+
+	if err := cfg.Print(os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Error printing configuration: %v\n", err)
+		return 1
+	}
+
+	if len(verr) > 0 {
+		for _, e := range verr {
+			fmt.Fprintln(os.Stderr, "invalid:", e)
+		}
+		return 1
 	}
 
-	log.Println("Server stopped")
+	return 0
 }
@@ -0,0 +1,151 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/config"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/middleware"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/service"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/tracing"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/utils"
+	"golang.org/x/exp/slog"
+)
+
+// How often singleton jobs delete stale rows
+const (
+	loginAttemptsPruneInterval   = 10 * time.Minute
+	idempotencyKeysPruneInterval = 10 * time.Minute
+	rateLimitPruneInterval       = 10 * time.Minute
+	userEventsPruneInterval      = 10 * time.Minute
+)
+
+// App holds the dependencies shared by every subcommand: the repository,
+// the accrual client, the order processor and the leader elector that runs
+// singleton jobs
+type App struct {
+	Config         *config.Config
+	Repo           repository.Repository
+	AccrualSvc     *service.AccrualService
+	OrderProcessor *service.OrderProcessor
+	LoginGuard     *service.LoginGuard
+	Idempotency    *service.IdempotencyService
+	RateLimiter    *service.RateLimiter
+	Events         *service.EventBroker
+	Leader         *service.LeaderElector
+
+	// shutdownTracing flushes buffered spans
+	shutdownTracing func(context.Context) error
+}
+
+// New wires the shared dependencies. Nothing is connected until Open.
+func New(cfg *config.Config) (*App, error) {
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:    cfg.TracingExporter,
+		Endpoint:    cfg.TracingEndpoint,
+		Insecure:    cfg.TracingInsecure,
+		SampleRatio: cfg.TracingSampleRatio,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	repo := repository.NewTracedRepository(repository.NewPostgresRepository(cfg.DatabaseURI))
+	accrualSvc := service.NewAccrualService(cfg.AccrualSystemAddress, cfg.AccrualTimeout)
+	loginGuard := service.NewLoginGuard(repo, service.DefaultLoginPolicy(), service.DefaultIPPolicy(), service.DefaultTOTPPolicy())
+	idempotency := service.NewIdempotencyService(repo, cfg.IdempotencyKeyTTL)
+
+	var rateLimitStore service.RateLimitStore
+	if cfg.RateLimitBackend == "postgres" {
+		rateLimitStore = service.NewPostgresRateLimitStore(repo)
+	} else {
+		rateLimitStore = service.NewMemoryRateLimitStore()
+	}
+	rateLimiter := service.NewRateLimiter(rateLimitStore, RateLimits(cfg))
+	events := service.NewEventBroker(repo)
+
+	// Jobs that must run on a single replica
+	leader := service.NewLeaderElector(repo, "jobs", cfg.LeaderRenewInterval)
+	leader.Register(service.LeaderJob{
+		Name:     "prune_login_attempts",
+		Interval: loginAttemptsPruneInterval,
+		Run:      loginGuard.Prune,
+	})
+	leader.Register(service.LeaderJob{
+		Name:     "prune_idempotency_keys",
+		Interval: idempotencyKeysPruneInterval,
+		Run:      idempotency.Prune,
+	})
+	leader.Register(service.LeaderJob{
+		Name:     "prune_user_events",
+		Interval: userEventsPruneInterval,
+		Run:      events.Prune,
+	})
+	if cfg.RateLimitBackend == "postgres" {
+		leader.Register(service.LeaderJob{
+			Name:     "prune_rate_limit_buckets",
+			Interval: rateLimitPruneInterval,
+			Run:      rateLimiter.Prune,
+		})
+	}
+
+	return &App{
+		Config:          cfg,
+		Repo:            repo,
+		AccrualSvc:      accrualSvc,
+		OrderProcessor:  service.NewOrderProcessor(repo, accrualSvc, cfg.AccrualPollInterval, cfg.WorkerConcurrency),
+		LoginGuard:      loginGuard,
+		Idempotency:     idempotency,
+		RateLimiter:     rateLimiter,
+		Events:          events,
+		Leader:          leader,
+		shutdownTracing: shutdownTracing,
+	}, nil
+}
+
+// RateLimits returns the rate limits per route group. The configuration
+// has been validated, so the limits parse.
+func RateLimits(cfg *config.Config) map[string]service.RateLimit {
+	limits := make(map[string]service.RateLimit)
+	for group, spec := range map[string]string{
+		middleware.RateLimitGroupAuth:   cfg.RateLimitAuth,
+		middleware.RateLimitGroupAPI:    cfg.RateLimitAPI,
+		middleware.RateLimitGroupOrders: cfg.RateLimitOrders,
+	} {
+		limit, period, _ := config.ParseRateLimit(spec)
+		limits[group] = service.RateLimit{Limit: limit, Period: period}
+	}
+	return limits
+}
+
+// Open connects to the database and, if enabled, updates the schema
+func (a *App) Open() error {
+	if err := a.Repo.InitDB(a.Config.DatabaseURI); err != nil {
+		return err
+	}
+
+	if a.Config.AutoMigrate {
+		return a.Migrate()
+	}
+	return nil
+}
+
+// Migrate updates the database schema
+func (a *App) Migrate() error {
+	slog.Info("Migrating database schema")
+	return a.Repo.Migrate()
+}
+
+// Close closes the database and flushes remaining spans
+func (a *App) Close(ctx context.Context) error {
+	var errs []error
+	if err := a.Repo.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("close repository: %w", err))
+	}
+	if err := a.shutdownTracing(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("shutdown tracing: %w", err))
+	}
+	return utils.JoinErrors(errs...)
+}
@@ -1,44 +1,628 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 // Config contains application configuration
 type Config struct {
-	RunAddress           string
-	DatabaseURI          string
-	AccrualSystemAddress string
+	RunAddress  string `yaml:"run_address"`
+	DatabaseURI string `yaml:"database_uri"`
+	// AutoMigrate updates the schema on startup; disable it to run
+	// "gophermart migrate" as a separate step
+	AutoMigrate          bool   `yaml:"auto_migrate"`
+	AccrualSystemAddress string `yaml:"accrual_system_address"`
+	// LogLevel is debug, info, warn or error
+	LogLevel string `yaml:"log_level"`
+	// AdminAddress serves metrics and diagnostics; empty disables it
+	AdminAddress string `yaml:"admin_address"`
+
+	// TLS, enabled when the certificate is set. Client certificates signed
+	// by the client CA are required if it is set.
+	TLSCertFile     string `yaml:"tls_cert_file"`
+	TLSKeyFile      string `yaml:"tls_key_file"`
+	TLSMinVersion   string `yaml:"tls_min_version"`
+	TLSClientCAFile string `yaml:"tls_client_ca_file"`
+	// HTTPRedirectAddress serves plain HTTP redirects to HTTPS; empty
+	// disables it
+	HTTPRedirectAddress string `yaml:"http_redirect_address"`
+
+	// Timeouts and intervals
+	RequestTimeout  time.Duration `yaml:"request_timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// ShutdownDrainDelay is how long /readyz reports failure before the
+	// server stops accepting connections, so load balancers can react
+	ShutdownDrainDelay  time.Duration `yaml:"shutdown_drain_delay"`
+	AccrualTimeout      time.Duration `yaml:"accrual_timeout"`
+	AccrualPollInterval time.Duration `yaml:"accrual_poll_interval"`
+
+	// Number of orders the worker checks with the accrual system at once
+	WorkerConcurrency int `yaml:"worker_concurrency"`
+
+	// How often the leader checks it still holds the advisory lock and
+	// other replicas try to take it over
+	LeaderRenewInterval time.Duration `yaml:"leader_renew_interval"`
+
+	// How long responses to requests with an Idempotency-Key are kept
+	IdempotencyKeyTTL time.Duration `yaml:"idempotency_key_ttl"`
+
+	// Rate limits per route group as "<requests>/<period>", e.g. "60/m";
+	// "0" disables the limit. Buckets are kept in memory or, to share the
+	// limits across replicas, in Postgres.
+	RateLimitBackend string `yaml:"rate_limit_backend"`
+	RateLimitAuth    string `yaml:"rate_limit_auth"`
+	RateLimitAPI     string `yaml:"rate_limit_api"`
+	RateLimitOrders  string `yaml:"rate_limit_orders"`
+
+	// Reverse proxies, as IPs or CIDRs, whose X-Forwarded-For and X-Real-IP
+	// headers name the client. Headers from other peers are ignored, so
+	// that clients can't pick the address the IP limits apply to.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// Responses smaller than CompressMinSize bytes are not compressed.
+	// Compressed request bodies may expand to at most MaxDecompressedSize
+	// bytes.
+	CompressMinSize     int   `yaml:"compress_min_size"`
+	MaxDecompressedSize int64 `yaml:"max_decompressed_size"`
+
+	// JWT signing. Tokens signed with a previous secret are still accepted,
+	// which allows the secret to be rotated without logging everyone out.
+	JWTSecret          string        `yaml:"jwt_secret"`
+	JWTPreviousSecrets []string      `yaml:"jwt_previous_secrets"`
+	JWTLifetime        time.Duration `yaml:"jwt_lifetime"`
+
+	// Password policy
+	PasswordMinLength     int    `yaml:"password_min_length"`
+	RejectedPasswordsFile string `yaml:"rejected_passwords_file"`
+
+	// Two-factor authentication
+	TOTPIssuer            string  `yaml:"totp_issuer"`
+	WithdrawTOTPThreshold float64 `yaml:"withdraw_totp_threshold"`
+
+	// OpenID Connect login, enabled when the issuer is set
+	OIDCIssuer       string `yaml:"oidc_issuer"`
+	OIDCClientID     string `yaml:"oidc_client_id"`
+	OIDCClientSecret string `yaml:"oidc_client_secret"`
+	OIDCRedirectURL  string `yaml:"oidc_redirect_url"`
+
+	// Tracing: exporter is none, stdout or otlp
+	TracingExporter    string  `yaml:"tracing_exporter"`
+	TracingEndpoint    string  `yaml:"tracing_endpoint"`
+	TracingInsecure    bool    `yaml:"tracing_insecure"`
+	TracingSampleRatio float64 `yaml:"tracing_sample_ratio"`
+
+	// Auth cookie attributes
+	CookieSecure   bool   `yaml:"cookie_secure"`
+	CookieSameSite string `yaml:"cookie_samesite"`
+	CookieDomain   string `yaml:"cookie_domain"`
+}
+
+// Default returns the configuration used when nothing else is set
+func Default() *Config {
+	return &Config{
+		RunAddress:          ":8080",
+		AdminAddress:        "localhost:9090",
+		LogLevel:            "info",
+		AutoMigrate:         true,
+		TLSMinVersion:       "1.2",
+		RequestTimeout:      60 * time.Second,
+		ShutdownTimeout:     10 * time.Second,
+		AccrualTimeout:      10 * time.Second,
+		AccrualPollInterval: 5 * time.Second,
+		WorkerConcurrency:   4,
+		LeaderRenewInterval: 5 * time.Second,
+		IdempotencyKeyTTL:   24 * time.Hour,
+		RateLimitBackend:    "memory",
+		RateLimitAuth:       "20/m",
+		RateLimitAPI:        "600/m",
+		RateLimitOrders:     "60/m",
+		CompressMinSize:     1024,
+		MaxDecompressedSize: 1 << 20,
+		JWTLifetime:         24 * time.Hour,
+		PasswordMinLength:   8,
+		TOTPIssuer:          "Gophermart",
+		CookieSameSite:      "lax",
+		TracingExporter:     "none",
+		TracingSampleRatio:  1,
+	}
+}
+
+// bindFlags registers a flag for every option, writing into cfg
+func bindFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.RunAddress, "a", cfg.RunAddress, "Server run address")
+	fs.StringVar(&cfg.DatabaseURI, "d", cfg.DatabaseURI, "Database URI")
+	fs.BoolVar(&cfg.AutoMigrate, "auto-migrate", cfg.AutoMigrate, "Update the database schema on startup")
+	fs.StringVar(&cfg.AccrualSystemAddress, "r", cfg.AccrualSystemAddress, "Accrual system address")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level: debug, info, warn or error")
+	fs.StringVar(&cfg.AdminAddress, "admin-address", cfg.AdminAddress, "Admin listener address for metrics, empty to disable")
+	fs.StringVar(&cfg.TLSCertFile, "tls-cert", cfg.TLSCertFile, "TLS certificate file")
+	fs.StringVar(&cfg.TLSKeyFile, "tls-key", cfg.TLSKeyFile, "TLS private key file")
+	fs.StringVar(&cfg.TLSMinVersion, "tls-min-version", cfg.TLSMinVersion, "Minimum TLS version: 1.2 or 1.3")
+	fs.StringVar(&cfg.TLSClientCAFile, "tls-client-ca", cfg.TLSClientCAFile, "CA file for verifying client certificates")
+	fs.StringVar(&cfg.HTTPRedirectAddress, "http-redirect-address", cfg.HTTPRedirectAddress, "Plain HTTP listener redirecting to HTTPS")
+	fs.DurationVar(&cfg.RequestTimeout, "request-timeout", cfg.RequestTimeout, "HTTP request timeout")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "Graceful shutdown timeout")
+	fs.DurationVar(&cfg.ShutdownDrainDelay, "shutdown-drain-delay", cfg.ShutdownDrainDelay, "Time between failing readiness and draining on shutdown")
+	fs.DurationVar(&cfg.AccrualTimeout, "accrual-timeout", cfg.AccrualTimeout, "Accrual system request timeout")
+	fs.DurationVar(&cfg.AccrualPollInterval, "accrual-poll-interval", cfg.AccrualPollInterval, "Pending orders poll interval")
+	fs.IntVar(&cfg.WorkerConcurrency, "worker-concurrency", cfg.WorkerConcurrency, "Orders checked with the accrual system at once")
+	fs.DurationVar(&cfg.LeaderRenewInterval, "leader-renew-interval", cfg.LeaderRenewInterval, "Leader election lease renewal interval")
+	fs.DurationVar(&cfg.IdempotencyKeyTTL, "idempotency-key-ttl", cfg.IdempotencyKeyTTL, "How long responses to requests with an Idempotency-Key are kept")
+	fs.StringVar(&cfg.RateLimitBackend, "rate-limit-backend", cfg.RateLimitBackend, "Rate limit backend: memory or postgres")
+	fs.StringVar(&cfg.RateLimitAuth, "rate-limit-auth", cfg.RateLimitAuth, "Rate limit of login and registration per IP, e.g. 20/m")
+	fs.StringVar(&cfg.RateLimitAPI, "rate-limit-api", cfg.RateLimitAPI, "Rate limit of authenticated requests per user, e.g. 600/m")
+	fs.StringVar(&cfg.RateLimitOrders, "rate-limit-orders", cfg.RateLimitOrders, "Rate limit of order uploads per user, e.g. 60/m")
+	fs.Var((*stringList)(&cfg.TrustedProxies), "trusted-proxies", "Comma-separated IPs or CIDRs of reverse proxies trusted to forward the client address")
+	fs.IntVar(&cfg.CompressMinSize, "compress-min-size", cfg.CompressMinSize, "Minimum response size in bytes to compress")
+	fs.Int64Var(&cfg.MaxDecompressedSize, "max-decompressed-size", cfg.MaxDecompressedSize, "Maximum size in bytes of a decompressed request body")
+	fs.StringVar(&cfg.JWTSecret, "jwt-secret", cfg.JWTSecret, "JWT signing secret")
+	fs.Var((*stringList)(&cfg.JWTPreviousSecrets), "jwt-previous-secrets", "Comma-separated previous JWT secrets still accepted for verification")
+	fs.DurationVar(&cfg.JWTLifetime, "jwt-lifetime", cfg.JWTLifetime, "JWT lifetime")
+	fs.IntVar(&cfg.PasswordMinLength, "password-min-length", cfg.PasswordMinLength, "Minimum password length")
+	fs.StringVar(&cfg.RejectedPasswordsFile, "rejected-passwords", cfg.RejectedPasswordsFile, "File with rejected passwords, one per line")
+	fs.StringVar(&cfg.TOTPIssuer, "totp-issuer", cfg.TOTPIssuer, "Issuer shown in authenticator apps")
+	fs.Float64Var(&cfg.WithdrawTOTPThreshold, "withdraw-totp-threshold", cfg.WithdrawTOTPThreshold, "Withdrawal sum above which a TOTP code is required")
+	fs.StringVar(&cfg.OIDCIssuer, "oidc-issuer", cfg.OIDCIssuer, "OpenID Connect issuer URL")
+	fs.StringVar(&cfg.OIDCClientID, "oidc-client-id", cfg.OIDCClientID, "OpenID Connect client ID")
+	fs.StringVar(&cfg.OIDCClientSecret, "oidc-client-secret", cfg.OIDCClientSecret, "OpenID Connect client secret")
+	fs.StringVar(&cfg.OIDCRedirectURL, "oidc-redirect-url", cfg.OIDCRedirectURL, "OpenID Connect redirect URL")
+	fs.StringVar(&cfg.TracingExporter, "tracing-exporter", cfg.TracingExporter, "Trace exporter: none, stdout or otlp")
+	fs.StringVar(&cfg.TracingEndpoint, "tracing-endpoint", cfg.TracingEndpoint, "OTLP/HTTP collector address, host:port")
+	fs.BoolVar(&cfg.TracingInsecure, "tracing-insecure", cfg.TracingInsecure, "Send traces to the collector without TLS")
+	fs.Float64Var(&cfg.TracingSampleRatio, "tracing-sample-ratio", cfg.TracingSampleRatio, "Fraction of new traces recorded")
+	fs.BoolVar(&cfg.CookieSecure, "cookie-secure", cfg.CookieSecure, "Send cookies over HTTPS only")
+	fs.StringVar(&cfg.CookieSameSite, "cookie-samesite", cfg.CookieSameSite, "Cookie SameSite mode: lax, strict or none")
+	fs.StringVar(&cfg.CookieDomain, "cookie-domain", cfg.CookieDomain, "Cookie domain")
+}
+
+// stringList is a comma-separated list flag
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = nil
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// envFlags maps environment variables to the flags they override
+var envFlags = []struct {
+	env  string
+	flag string
+}{
+	{"RUN_ADDRESS", "a"},
+	{"DATABASE_URI", "d"},
+	{"AUTO_MIGRATE", "auto-migrate"},
+	{"ACCRUAL_SYSTEM_ADDRESS", "r"},
+	{"LOG_LEVEL", "log-level"},
+	{"ADMIN_ADDRESS", "admin-address"},
+	{"TLS_CERT_FILE", "tls-cert"},
+	{"TLS_KEY_FILE", "tls-key"},
+	{"TLS_MIN_VERSION", "tls-min-version"},
+	{"TLS_CLIENT_CA_FILE", "tls-client-ca"},
+	{"HTTP_REDIRECT_ADDRESS", "http-redirect-address"},
+	{"REQUEST_TIMEOUT", "request-timeout"},
+	{"SHUTDOWN_TIMEOUT", "shutdown-timeout"},
+	{"SHUTDOWN_DRAIN_DELAY", "shutdown-drain-delay"},
+	{"ACCRUAL_TIMEOUT", "accrual-timeout"},
+	{"ACCRUAL_POLL_INTERVAL", "accrual-poll-interval"},
+	{"WORKER_CONCURRENCY", "worker-concurrency"},
+	{"LEADER_RENEW_INTERVAL", "leader-renew-interval"},
+	{"IDEMPOTENCY_KEY_TTL", "idempotency-key-ttl"},
+	{"RATE_LIMIT_BACKEND", "rate-limit-backend"},
+	{"RATE_LIMIT_AUTH", "rate-limit-auth"},
+	{"RATE_LIMIT_API", "rate-limit-api"},
+	{"RATE_LIMIT_ORDERS", "rate-limit-orders"},
+	{"TRUSTED_PROXIES", "trusted-proxies"},
+	{"COMPRESS_MIN_SIZE", "compress-min-size"},
+	{"MAX_DECOMPRESSED_SIZE", "max-decompressed-size"},
+	{"JWT_SECRET", "jwt-secret"},
+	{"JWT_PREVIOUS_SECRETS", "jwt-previous-secrets"},
+	{"JWT_LIFETIME", "jwt-lifetime"},
+	{"PASSWORD_MIN_LENGTH", "password-min-length"},
+	{"REJECTED_PASSWORDS_FILE", "rejected-passwords"},
+	{"TOTP_ISSUER", "totp-issuer"},
+	{"WITHDRAW_TOTP_THRESHOLD", "withdraw-totp-threshold"},
+	{"OIDC_ISSUER", "oidc-issuer"},
+	{"OIDC_CLIENT_ID", "oidc-client-id"},
+	{"OIDC_CLIENT_SECRET", "oidc-client-secret"},
+	{"OIDC_REDIRECT_URL", "oidc-redirect-url"},
+	{"TRACING_EXPORTER", "tracing-exporter"},
+	{"TRACING_ENDPOINT", "tracing-endpoint"},
+	{"TRACING_INSECURE", "tracing-insecure"},
+	{"TRACING_SAMPLE_RATIO", "tracing-sample-ratio"},
+	{"COOKIE_SECURE", "cookie-secure"},
+	{"COOKIE_SAMESITE", "cookie-samesite"},
+	{"COOKIE_DOMAIN", "cookie-domain"},
+}
+
+// Command is the kind of subcommand a configuration is loaded for. Settings
+// that only some commands use are required only for those.
+type Command int
+
+const (
+	// CommandRun runs the HTTP API, the order processor or both, and needs
+	// the database and the accrual system
+	CommandRun Command = iota
+	// CommandDatabase works on the database only, like migrate and admin
+	CommandDatabase
+	// CommandPrint prints the configuration and needs nothing
+	CommandPrint
+)
+
+// Load builds the configuration from command-line arguments, environment
+// variables and an optional config file. Precedence is flags > env > file
+// > defaults. If validation for the command fails, the configuration is
+// returned together with a ValidationError listing every problem.
+// Positional arguments are rejected.
+func Load(cmd Command, args []string) (*Config, error) {
+	cfg, rest, err := LoadArgs(cmd, args)
+	if err == nil && len(rest) > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", rest[0])
+	}
+	return cfg, err
+}
+
+// LoadArgs is like Load but returns the positional arguments that follow
+// the flags
+func LoadArgs(cmd Command, args []string) (*Config, []string, error) {
+	// First pass: parse flags into a scratch config to learn which flags
+	// were set and where the config file is
+	scratch := Default()
+	fs := flag.NewFlagSet("gophermart", flag.ContinueOnError)
+	bindFlags(fs, scratch)
+	var configFile string
+	fs.StringVar(&configFile, "c", "", "Config file (JSON or YAML)")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	setFlags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+
+	if configFile == "" {
+		configFile = os.Getenv("CONFIG")
+	}
+
+	// Second pass: apply every source in order of increasing precedence
+	cfg := Default()
+	if configFile != "" {
+		if err := cfg.loadFile(configFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	apply := flag.NewFlagSet("gophermart", flag.ContinueOnError)
+	bindFlags(apply, cfg)
+
+	var errs ValidationError
+	for _, ef := range envFlags {
+		if v, ok := os.LookupEnv(ef.env); ok && v != "" {
+			if err := apply.Set(ef.flag, v); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: invalid value %q", ef.env, v))
+			}
+		}
+	}
+
+	for name, v := range setFlags {
+		if name == "c" {
+			continue
+		}
+		// The value has already been parsed once, so it can't fail here
+		apply.Set(name, v)
+	}
+
+	errs = append(errs, cfg.validate(cmd)...)
+	if len(errs) > 0 {
+		return cfg, fs.Args(), errs
+	}
+
+	return cfg, fs.Args(), nil
+}
+
+// loadFile reads a JSON or YAML config file. JSON is a subset of YAML, so a
+// single decoder handles both.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".yaml", ".yml":
+	default:
+		return fmt.Errorf("config file %s: unsupported format, use .json, .yaml or .yml", path)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+
+	return nil
 }
 
-// NewConfig creates a new configuration from environment variables or flags
-func NewConfig() *Config {
-	var cfg Config
+// ValidationError lists every problem found in the configuration
+type ValidationError []string
 
-	// Parse flags
-	flag.StringVar(&cfg.RunAddress, "a", "", "Server run address")
-	flag.StringVar(&cfg.DatabaseURI, "d", "", "Database URI")
-	flag.StringVar(&cfg.AccrualSystemAddress, "r", "", "Accrual system address")
-	flag.Parse()
+func (e ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e, "\n  - ")
+}
+
+// validate returns a list of problems with the configuration for the
+// command
+func (c *Config) validate(cmd Command) ValidationError {
+	var errs ValidationError
+
+	if c.RunAddress == "" {
+		errs = append(errs, "run address is required (RUN_ADDRESS, -a)")
+	}
+	if c.AdminAddress != "" && c.AdminAddress == c.RunAddress {
+		errs = append(errs, "admin address must differ from the run address")
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, "TLS certificate and key must be set together")
+	}
+	if c.TLSMinVersion != "1.2" && c.TLSMinVersion != "1.3" {
+		errs = append(errs, fmt.Sprintf("TLS minimum version must be 1.2 or 1.3, got %q", c.TLSMinVersion))
+	}
+	if c.TLSCertFile == "" && c.TLSClientCAFile != "" {
+		errs = append(errs, "TLS client CA requires a TLS certificate")
+	}
+	if c.TLSCertFile == "" && c.HTTPRedirectAddress != "" {
+		errs = append(errs, "HTTP redirect address requires a TLS certificate")
+	}
+	if c.HTTPRedirectAddress != "" && (c.HTTPRedirectAddress == c.RunAddress || c.HTTPRedirectAddress == c.AdminAddress) {
+		errs = append(errs, "HTTP redirect address must differ from the run and admin addresses")
+	}
+	if c.DatabaseURI == "" && cmd != CommandPrint {
+		errs = append(errs, "database URI is required (DATABASE_URI, -d)")
+	}
+	if c.AccrualSystemAddress == "" {
+		if cmd == CommandRun {
+			errs = append(errs, "accrual system address is required (ACCRUAL_SYSTEM_ADDRESS, -r)")
+		}
+	} else if u, err := url.Parse(c.AccrualSystemAddress); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Sprintf("accrual system address %q must be an absolute URL", c.AccrualSystemAddress))
+	}
+
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"request timeout", c.RequestTimeout},
+		{"shutdown timeout", c.ShutdownTimeout},
+		{"accrual timeout", c.AccrualTimeout},
+		{"accrual poll interval", c.AccrualPollInterval},
+		{"leader renew interval", c.LeaderRenewInterval},
+		{"idempotency key TTL", c.IdempotencyKeyTTL},
+		{"JWT lifetime", c.JWTLifetime},
+	} {
+		if d.value <= 0 {
+			errs = append(errs, fmt.Sprintf("%s must be positive, got %s", d.name, d.value))
+		}
+	}
+
+	if c.ShutdownDrainDelay < 0 {
+		errs = append(errs, "shutdown drain delay must not be negative")
+	} else if c.ShutdownDrainDelay >= c.ShutdownTimeout {
+		errs = append(errs, "shutdown drain delay must be shorter than the shutdown timeout")
+	}
+	if c.WorkerConcurrency < 1 {
+		errs = append(errs, "worker concurrency must be at least 1")
+	}
+	if c.CompressMinSize < 0 {
+		errs = append(errs, "compress minimum size must not be negative")
+	}
+	if c.MaxDecompressedSize < 1 {
+		errs = append(errs, "maximum decompressed size must be at least 1")
+	}
+	if c.PasswordMinLength < 1 {
+		errs = append(errs, "password minimum length must be at least 1")
+	}
+	if c.WithdrawTOTPThreshold < 0 {
+		errs = append(errs, "withdraw TOTP threshold must not be negative")
+	}
 
-	// Override with env vars if present
-	if envAddr := os.Getenv("RUN_ADDRESS"); envAddr != "" {
-		cfg.RunAddress = envAddr
+	switch strings.ToLower(c.CookieSameSite) {
+	case "lax", "strict":
+	case "none":
+		if !c.CookieSecure {
+			errs = append(errs, "cookie SameSite=none requires secure cookies")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("cookie SameSite must be lax, strict or none, got %q", c.CookieSameSite))
 	}
 
-	if envDBURI := os.Getenv("DATABASE_URI"); envDBURI != "" {
-		cfg.DatabaseURI = envDBURI
+	switch strings.ToLower(c.LogLevel) {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Sprintf("log level must be debug, info, warn or error, got %q", c.LogLevel))
 	}
 
-	if envAccrualAddr := os.Getenv("ACCRUAL_SYSTEM_ADDRESS"); envAccrualAddr != "" {
-		cfg.AccrualSystemAddress = envAccrualAddr
+	switch c.RateLimitBackend {
+	case "memory", "postgres":
+	default:
+		errs = append(errs, fmt.Sprintf("rate limit backend must be memory or postgres, got %q", c.RateLimitBackend))
 	}
+	for _, l := range []struct {
+		name  string
+		value string
+	}{
+		{"auth", c.RateLimitAuth},
+		{"API", c.RateLimitAPI},
+		{"orders", c.RateLimitOrders},
+	} {
+		if _, _, err := ParseRateLimit(l.value); err != nil {
+			errs = append(errs, fmt.Sprintf("%s rate limit: %v", l.name, err))
+		}
+	}
+
+	if _, err := ParseTrustedProxies(c.TrustedProxies); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	switch c.TracingExporter {
+	case "none", "stdout", "otlp":
+	default:
+		errs = append(errs, fmt.Sprintf("tracing exporter must be none, stdout or otlp, got %q", c.TracingExporter))
+	}
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		errs = append(errs, "tracing sample ratio must be between 0 and 1")
+	}
+
+	if c.OIDCIssuer != "" {
+		if c.OIDCClientID == "" {
+			errs = append(errs, "OIDC client ID is required when the OIDC issuer is set")
+		}
+		if c.OIDCRedirectURL == "" {
+			errs = append(errs, "OIDC redirect URL is required when the OIDC issuer is set")
+		}
+	}
+
+	return errs
+}
+
+// ParseRateLimit parses a rate limit of the form "<requests>/<period>".
+// The period is a unit (s, m, h) or a duration such as 10s. An empty
+// string or "0" means no limit and returns a zero count.
+func ParseRateLimit(s string) (int, time.Duration, error) {
+	if s == "" || s == "0" {
+		return 0, 0, nil
+	}
+
+	count, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("%q must be <requests>/<period>, e.g. 60/m", s)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return 0, 0, fmt.Errorf("%q: invalid number of requests", s)
+	}
+
+	switch period {
+	case "s", "m", "h":
+		period = "1" + period
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return 0, 0, fmt.Errorf("%q: invalid period", s)
+	}
+
+	return n, d, nil
+}
+
+// ParseTrustedProxies parses the trusted proxy list. A bare IP stands for
+// that single address.
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q is not an IP or CIDR", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an IP or CIDR", proxy)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// redacted is shown instead of secret values
+const redacted = "REDACTED"
+
+// dsnPassword matches the password in a key=value connection string
+var dsnPassword = regexp.MustCompile(`(password=)\S+`)
+
+// Redacted returns a copy of the configuration with secrets hidden
+func (c *Config) Redacted() *Config {
+	out := *c
+
+	if out.JWTSecret != "" {
+		out.JWTSecret = redacted
+	}
+	if len(out.JWTPreviousSecrets) > 0 {
+		out.JWTPreviousSecrets = make([]string, len(c.JWTPreviousSecrets))
+		for i := range out.JWTPreviousSecrets {
+			out.JWTPreviousSecrets[i] = redacted
+		}
+	}
+	if out.OIDCClientSecret != "" {
+		out.OIDCClientSecret = redacted
+	}
+	if u, err := url.Parse(out.DatabaseURI); err == nil && u.Scheme != "" {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			out.DatabaseURI = u.String()
+		}
+	} else {
+		out.DatabaseURI = dsnPassword.ReplaceAllString(out.DatabaseURI, "${1}"+redacted)
+	}
+
+	return &out
+}
+
+// Print writes the configuration as YAML with secrets redacted
+func (c *Config) Print(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.Redacted()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// Diff returns the config file keys of the options that differ between c
+// and other
+func (c *Config) Diff(other *Config) []string {
+	var changed []string
 
-	// Set defaults if needed
-	if cfg.RunAddress == "" {
-		cfg.RunAddress = ":8080"
+	a := reflect.ValueOf(c).Elem()
+	b := reflect.ValueOf(other).Elem()
+	for i := 0; i < a.NumField(); i++ {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, a.Type().Field(i).Tag.Get("yaml"))
+		}
 	}
 
-	return &cfg
+	return changed
 }
@@ -0,0 +1,205 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// clearEnv hides the environment variables of the options and the config
+// file from the test
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, ef := range envFlags {
+		t.Setenv(ef.env, "")
+	}
+	t.Setenv("CONFIG", "")
+}
+
+// writeConfigFile writes a config file into a temporary directory
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	const required = "database_uri: postgres://localhost/gophermart\naccrual_system_address: http://localhost:8081\n"
+	file := writeConfigFile(t, "config.yaml", required+"log_level: warn\nworker_concurrency: 8\nrun_address: :7070\n")
+	other := writeConfigFile(t, "other.json", `{"database_uri": "postgres://localhost/other", "accrual_system_address": "http://localhost:8081", "log_level": "error"}`)
+
+	tests := []struct {
+		name            string
+		env             map[string]string
+		args            []string
+		wantLogLevel    string
+		wantConcurrency int
+		wantRunAddress  string
+		wantDatabaseURI string
+	}{
+		{
+			name:         "defaults",
+			args:         []string{"-d", "postgres://localhost/flag", "-r", "http://localhost:8081"},
+			wantLogLevel: "info", wantConcurrency: 4, wantRunAddress: ":8080", wantDatabaseURI: "postgres://localhost/flag",
+		},
+		{
+			name:         "file over defaults",
+			args:         []string{"-c", file},
+			wantLogLevel: "warn", wantConcurrency: 8, wantRunAddress: ":7070", wantDatabaseURI: "postgres://localhost/gophermart",
+		},
+		{
+			name:         "env over file",
+			env:          map[string]string{"LOG_LEVEL": "debug", "WORKER_CONCURRENCY": "2"},
+			args:         []string{"-c", file},
+			wantLogLevel: "debug", wantConcurrency: 2, wantRunAddress: ":7070", wantDatabaseURI: "postgres://localhost/gophermart",
+		},
+		{
+			name:         "flags over env",
+			env:          map[string]string{"LOG_LEVEL": "debug", "RUN_ADDRESS": ":6060"},
+			args:         []string{"-c", file, "-log-level", "error", "-a", ":5050"},
+			wantLogLevel: "error", wantConcurrency: 8, wantRunAddress: ":5050", wantDatabaseURI: "postgres://localhost/gophermart",
+		},
+		{
+			name:         "empty env is ignored",
+			env:          map[string]string{"LOG_LEVEL": ""},
+			args:         []string{"-c", file},
+			wantLogLevel: "warn", wantConcurrency: 8, wantRunAddress: ":7070", wantDatabaseURI: "postgres://localhost/gophermart",
+		},
+		{
+			name:         "file from CONFIG",
+			env:          map[string]string{"CONFIG": file},
+			wantLogLevel: "warn", wantConcurrency: 8, wantRunAddress: ":7070", wantDatabaseURI: "postgres://localhost/gophermart",
+		},
+		{
+			name:         "flag over CONFIG",
+			env:          map[string]string{"CONFIG": file},
+			args:         []string{"-c", other},
+			wantLogLevel: "error", wantConcurrency: 4, wantRunAddress: ":8080", wantDatabaseURI: "postgres://localhost/other",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			cfg, err := Load(CommandRun, tt.args)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if cfg.LogLevel != tt.wantLogLevel {
+				t.Errorf("got log level %q, want %q", cfg.LogLevel, tt.wantLogLevel)
+			}
+			if cfg.WorkerConcurrency != tt.wantConcurrency {
+				t.Errorf("got worker concurrency %d, want %d", cfg.WorkerConcurrency, tt.wantConcurrency)
+			}
+			if cfg.RunAddress != tt.wantRunAddress {
+				t.Errorf("got run address %q, want %q", cfg.RunAddress, tt.wantRunAddress)
+			}
+			if cfg.DatabaseURI != tt.wantDatabaseURI {
+				t.Errorf("got database URI %q, want %q", cfg.DatabaseURI, tt.wantDatabaseURI)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	unknownKey := writeConfigFile(t, "config.yaml", "log_levle: debug\n")
+	wrongFormat := writeConfigFile(t, "config.toml", "log_level = \"debug\"\n")
+
+	tests := []struct {
+		name     string
+		cmd      Command
+		env      map[string]string
+		args     []string
+		wantErrs []string
+	}{
+		{
+			name:     "run needs the database and the accrual system",
+			cmd:      CommandRun,
+			wantErrs: []string{"database URI is required", "accrual system address is required"},
+		},
+		{
+			name:     "migrate and admin need the database only",
+			cmd:      CommandDatabase,
+			wantErrs: []string{"database URI is required"},
+		},
+		{
+			name: "migrate and admin don't need the accrual system",
+			cmd:  CommandDatabase,
+			args: []string{"-d", "postgres://localhost/gophermart"},
+		},
+		{
+			name: "print needs nothing",
+			cmd:  CommandPrint,
+		},
+		{
+			name:     "print still reports invalid values",
+			cmd:      CommandPrint,
+			args:     []string{"-r", "localhost:8081", "-log-level", "loud"},
+			wantErrs: []string{"must be an absolute URL", "log level must be"},
+		},
+		{
+			name:     "invalid env value",
+			cmd:      CommandPrint,
+			env:      map[string]string{"AUTO_MIGRATE": "maybe"},
+			wantErrs: []string{`AUTO_MIGRATE: invalid value "maybe"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			_, err := Load(tt.cmd, tt.args)
+			if len(tt.wantErrs) == 0 {
+				if err != nil {
+					t.Fatalf("Load: %v", err)
+				}
+				return
+			}
+
+			var verr ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("got error %v, want a ValidationError", err)
+			}
+			if len(verr) != len(tt.wantErrs) {
+				t.Fatalf("got %d problems, want %d: %v", len(verr), len(tt.wantErrs), verr)
+			}
+			for i, want := range tt.wantErrs {
+				if !strings.Contains(verr[i], want) {
+					t.Errorf("problem %d: got %q, want it to contain %q", i, verr[i], want)
+				}
+			}
+		})
+	}
+
+	t.Run("unknown key in file", func(t *testing.T) {
+		clearEnv(t)
+		if _, err := Load(CommandPrint, []string{"-c", unknownKey}); err == nil || !strings.Contains(err.Error(), "log_levle") {
+			t.Fatalf("got error %v, want one naming the unknown key", err)
+		}
+	})
+	t.Run("unsupported file format", func(t *testing.T) {
+		clearEnv(t)
+		if _, err := Load(CommandPrint, []string{"-c", wrongFormat}); err == nil || !strings.Contains(err.Error(), "unsupported format") {
+			t.Fatalf("got error %v, want an unsupported format error", err)
+		}
+	})
+	t.Run("positional argument", func(t *testing.T) {
+		clearEnv(t)
+		if _, err := Load(CommandPrint, []string{"extra"}); err == nil {
+			t.Fatal("positional argument was accepted")
+		}
+	})
+}
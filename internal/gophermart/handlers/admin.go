@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// Admin user search limits
+const (
+	defaultUserSearchLimit = 50
+	maxUserSearchLimit     = 200
+)
+
+// AdminSearchUsers searches users by login
+func (h *Handler) AdminSearchUsers(w http.ResponseWriter, r *http.Request) {
+	limit := defaultUserSearchLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if n < maxUserSearchLimit {
+			limit = n
+		} else {
+			limit = maxUserSearchLimit
+		}
+	}
+
+	users, err := h.Repo.SearchUsers(r.Context(), r.URL.Query().Get("login"), limit)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// If no users, return 204
+	if len(users) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// AdminGetUser returns a user
+func (h *Handler) AdminGetUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.adminLoadUser(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// AdminGetUserOrders returns any user's orders
+func (h *Handler) AdminGetUserOrders(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.adminLoadUser(w, r)
+	if !ok {
+		return
+	}
+
+	orders, err := h.Repo.GetUserOrders(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// If no orders, return 204
+	if len(orders) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writeOrders(w, orders)
+}
+
+// AdminGetUserWithdrawals returns any user's withdrawals
+func (h *Handler) AdminGetUserWithdrawals(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.adminLoadUser(w, r)
+	if !ok {
+		return
+	}
+
+	withdrawals, err := h.Repo.GetUserWithdrawals(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// If no withdrawals, return 204
+	if len(withdrawals) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writeWithdrawals(w, withdrawals)
+}
+
+// AdminGetUserBalance returns any user's balance
+func (h *Handler) AdminGetUserBalance(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.adminLoadUser(w, r)
+	if !ok {
+		return
+	}
+
+	balance, err := h.Repo.GetUserBalance(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(balance)
+}
+
+// AdminRequeueOrder resets a stuck order so that the worker processes it again
+func (h *Handler) AdminRequeueOrder(w http.ResponseWriter, r *http.Request) {
+	orderNumber := chi.URLParam(r, "number")
+
+	ctx := r.Context()
+	order, err := h.Repo.GetOrderByNumber(ctx, orderNumber)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if order == nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	requeued, err := h.Repo.RequeueOrder(ctx, orderNumber)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !requeued {
+		http.Error(w, "Order is already processed", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// AdminDisableUser disables a user account
+func (h *Handler) AdminDisableUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.adminLoadUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.Repo.SetUserDisabled(r.Context(), user.ID, true); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// AdminSetUserRole changes a user's role
+func (h *Handler) AdminSetUserRole(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.adminLoadUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+
+	// Parse request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if !models.IsValidRole(req.Role) {
+		http.Error(w, "Unknown role", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Repo.SetUserRole(r.Context(), user.ID, req.Role); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// adminLoadUser loads the user referenced by the {id} URL parameter and
+// writes an error response if it can't
+func (h *Handler) adminLoadUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return nil, false
+	}
+
+	user, err := h.Repo.GetUserByID(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if user == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return user, true
+}
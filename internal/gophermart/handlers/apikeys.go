@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/middleware"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/service"
+	"github.com/go-chi/chi/v5"
+)
+
+// CreateAPIKey issues a new API key for the user
+func (h *Handler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := middleware.GetUserID(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	}
+
+	// Parse request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		http.Error(w, "Expiry must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	plaintext, key, err := h.APIKeys.Create(ctx, userID, req.Name, req.Scopes, req.ExpiresAt)
+	if errors.Is(err, service.ErrNoScopes) || errors.Is(err, service.ErrUnknownScope) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, models.EventAPIKeyCreated, userID, map[string]string{"key_id": strconv.FormatInt(key.ID, 10), "name": key.Name})
+
+	// The plaintext key is shown only once
+	response := struct {
+		Key string `json:"key"`
+		*models.APIKey
+	}{
+		Key:    plaintext,
+		APIKey: key,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// ListAPIKeys returns the user's API keys without their secrets
+func (h *Handler) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := middleware.GetUserID(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ctx := r.Context()
+	keys, err := h.APIKeys.List(ctx, userID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// If no keys, return 204
+	if len(keys) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// RevokeAPIKey revokes one of the user's API keys
+func (h *Handler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := middleware.GetUserID(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	keyID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	revoked, err := h.APIKeys.Revoke(ctx, userID, keyID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !revoked {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	h.audit(r, models.EventAPIKeyRevoked, userID, map[string]string{"key_id": strconv.FormatInt(keyID, 10)})
+
+	w.WriteHeader(http.StatusNoContent)
+}
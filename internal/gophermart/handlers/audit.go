@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/middleware"
+)
+
+// Security events list limits
+const (
+	defaultSecurityEventsLimit = 50
+	maxSecurityEventsLimit     = 500
+)
+
+// GetSecurityEvents returns the user's own audit log
+func (h *Handler) GetSecurityEvents(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := middleware.GetUserID(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limit := defaultSecurityEventsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if n < maxSecurityEventsLimit {
+			limit = n
+		} else {
+			limit = maxSecurityEventsLimit
+		}
+	}
+
+	events, err := h.Audit.List(r.Context(), userID, limit)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// If no events, return 204
+	if len(events) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// audit records a security event for the request
+func (h *Handler) audit(r *http.Request, eventType string, userID int64, details map[string]string) {
+	h.Audit.Record(r.Context(), middleware.NewAuditEvent(r, eventType, userID, details))
+}
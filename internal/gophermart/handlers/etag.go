@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/middleware"
+)
+
+// notModified sets the ETag of a response built from the user's orders and
+// withdrawals and answers 304 if the client's copy, named in
+// If-None-Match, is current. It returns true if the response has been
+// written.
+//
+// The ETag is derived from the user's data version, which is read before
+// the data: if the data changes in between, the response is newer than its
+// ETag and the next request simply gets it again.
+func (h *Handler) notModified(w http.ResponseWriter, r *http.Request, userID int64) bool {
+	version, err := h.Repo.GetUserDataVersion(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return true
+	}
+	return notModifiedSince(w, r, userID, version)
+}
+
+// notModifiedSince sets the ETag of a response built from the user's data
+// at the given data version and answers 304 if the client's copy is
+// current. It returns true if the response has been written.
+func notModifiedSince(w http.ResponseWriter, r *http.Request, userID, version int64) bool {
+	// The user ID is part of the tag since every user has the same URLs
+	etag := fmt.Sprintf(`"%d-%d"`, userID, version)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// etagMatches reports whether the If-None-Match header lists the ETag.
+// Weak tags match too, as GET uses the weak comparison, and so do the
+// encoding-specific tags of compressed responses.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = middleware.DecodedETag(strings.TrimPrefix(strings.TrimSpace(tag), "W/"))
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/middleware"
+)
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{name: "no header", header: "", want: false},
+		{name: "same tag", header: `"42-7"`, want: true},
+		{name: "weak tag", header: `W/"42-7"`, want: true},
+		{name: "gzip tag", header: `"42-7-gzip"`, want: true},
+		{name: "deflate tag", header: `"42-7-deflate"`, want: true},
+		{name: "weak gzip tag", header: `W/"42-7-gzip"`, want: true},
+		{name: "wildcard", header: "*", want: true},
+		{name: "one of several", header: `"42-6", "42-7-gzip"`, want: true},
+		{name: "older version", header: `"42-6"`, want: false},
+		{name: "other user", header: `"43-7"`, want: false},
+		{name: "unknown encoding", header: `"42-7-br"`, want: false},
+		{name: "unquoted", header: `42-7`, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := etagMatches(tt.header, `"42-7"`); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotModifiedSince(t *testing.T) {
+	// The response is large enough to be compressed
+	body := strings.Repeat(`{"number":"12345678903","status":"PROCESSED"},`, 20)
+	h := middleware.Compress(256)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if notModifiedSince(w, r, 42, 7) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	}))
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		ifNoneMatch    string
+		want           int
+		wantETag       string
+	}{
+		{name: "first request", want: http.StatusOK, wantETag: `"42-7"`},
+		{name: "first compressed request", acceptEncoding: "gzip", want: http.StatusOK, wantETag: `"42-7-gzip"`},
+		{name: "current copy", ifNoneMatch: `"42-7"`, want: http.StatusNotModified, wantETag: `"42-7"`},
+		{name: "current compressed copy", acceptEncoding: "gzip", ifNoneMatch: `"42-7-gzip"`, want: http.StatusNotModified, wantETag: `"42-7"`},
+		{name: "encoding changed since", ifNoneMatch: `"42-7-gzip"`, want: http.StatusNotModified, wantETag: `"42-7"`},
+		{name: "stale copy", acceptEncoding: "gzip", ifNoneMatch: `"42-6-gzip"`, want: http.StatusOK, wantETag: `"42-7-gzip"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.want)
+			}
+			if got := rec.Header().Get("ETag"); got != tt.wantETag {
+				t.Fatalf("got ETag %q, want %q", got, tt.wantETag)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != "private, no-cache" {
+				t.Fatalf("got Cache-Control %q", got)
+			}
+			if tt.want == http.StatusNotModified && rec.Body.Len() != 0 {
+				t.Fatalf("304 has a body of %d bytes", rec.Body.Len())
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/middleware"
+)
+
+const (
+	// eventsBatchSize is the number of events read from the repository at
+	// once
+	eventsBatchSize = 100
+	// eventsKeepAlive is how often a comment is sent on an idle stream so
+	// that proxies don't close it
+	eventsKeepAlive = 15 * time.Second
+	// eventsRetry is the reconnection delay suggested to clients
+	eventsRetry = 3 * time.Second
+)
+
+// StreamEvents streams order status changes and balance changes of the
+// user as server-sent events. A client reconnecting with Last-Event-ID
+// gets the events it missed first. The stream ends when the token
+// expires, and the credentials are checked again with every keep-alive,
+// so a revoked key or a disabled user doesn't keep receiving events.
+func (h *Handler) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := middleware.GetUserID(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe before reading the backlog so that no event falls between
+	ctx := r.Context()
+	sub := h.Events.Subscribe(userID)
+	defer sub.Close()
+
+	var lastID int64
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		id, err := strconv.ParseInt(header, 10, 64)
+		if err != nil || id < 0 {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		lastID = id
+	} else {
+		// A new stream starts with the next event
+		id, err := h.Repo.GetLatestUserEventID(ctx, userID)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		lastID = id
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventsRetry.Milliseconds())
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+
+	// A nil channel never fires for credentials without an expiry
+	var expired <-chan time.Time
+	if expiresAt, ok := middleware.GetExpiresAt(ctx); ok {
+		timer := time.NewTimer(time.Until(expiresAt))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		// Send everything after the last event sent
+		for {
+			events, err := h.Repo.GetUserEvents(ctx, userID, lastID, eventsBatchSize)
+			if err != nil {
+				if ctx.Err() == nil {
+					logging.FromContext(ctx).Error("Error getting user events", "error", err)
+				}
+				return
+			}
+			for _, e := range events {
+				if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data); err != nil {
+					return
+				}
+				lastID = e.ID
+			}
+			if len(events) < eventsBatchSize {
+				break
+			}
+		}
+		flusher.Flush()
+
+		select {
+		case _, ok := <-sub.C:
+			if !ok {
+				// The server is shutting down; the client reconnects
+				return
+			}
+		case <-keepAlive.C:
+			valid, err := h.JWT.Revalidate(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					logging.FromContext(ctx).Error("Error revalidating credentials", "error", err)
+				}
+				return
+			}
+			if !valid {
+				return
+			}
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-expired:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
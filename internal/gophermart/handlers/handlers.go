@@ -3,31 +3,80 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/metrics"
 	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/middleware"
 	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
 	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
 	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/service"
 	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/utils"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/go-chi/chi/v5"
 )
 
 // Handler handles all HTTP requests
 type Handler struct {
 	Repo       repository.Repository
-	AccrualSvc *service.AccrualService
-	JWTSecret  string
+	LoginGuard *service.LoginGuard
+	Hasher     service.PasswordHasher
+	Policy     *service.PasswordPolicy
+	TwoFactor  *service.TwoFactorService
+	APIKeys    *service.APIKeyService
+	OIDC       *service.OIDCService
+	JWT        *middleware.JWTConfig
+	Cookies    middleware.CookieConfig
+	Audit      *service.AuditService
+	Events     *service.EventBroker
+	// RateLimiter limits requests sent over WebSocket connections, which
+	// the rate limiting middleware doesn't see
+	RateLimiter *service.RateLimiter
+
+	// WithdrawTOTPThreshold is the withdrawal amount above which users with
+	// two-factor authentication must confirm with a TOTP code
+	WithdrawTOTPThreshold float64
+	// RequestTimeout is the timeout of API requests, which long polls must
+	// stay within
+	RequestTimeout time.Duration
 }
 
 // NewHandler creates a new handler
-func NewHandler(repo repository.Repository, accrualSvc *service.AccrualService, jwtSecret string) *Handler {
+func NewHandler(
+	repo repository.Repository,
+	loginGuard *service.LoginGuard,
+	hasher service.PasswordHasher,
+	policy *service.PasswordPolicy,
+	twoFactor *service.TwoFactorService,
+	apiKeys *service.APIKeyService,
+	oidc *service.OIDCService,
+	jwt *middleware.JWTConfig,
+	cookies middleware.CookieConfig,
+	audit *service.AuditService,
+	events *service.EventBroker,
+	rateLimiter *service.RateLimiter,
+	withdrawTOTPThreshold float64,
+	requestTimeout time.Duration,
+) *Handler {
 	return &Handler{
-		Repo:       repo,
-		AccrualSvc: accrualSvc,
-		JWTSecret:  jwtSecret,
+		Repo:                  repo,
+		LoginGuard:            loginGuard,
+		Hasher:                hasher,
+		Policy:                policy,
+		TwoFactor:             twoFactor,
+		APIKeys:               apiKeys,
+		OIDC:                  oidc,
+		JWT:                   jwt,
+		Cookies:               cookies,
+		Audit:                 audit,
+		Events:                events,
+		RateLimiter:           rateLimiter,
+		WithdrawTOTPThreshold: withdrawTOTPThreshold,
+		RequestTimeout:        requestTimeout,
 	}
 }
 
@@ -49,6 +98,12 @@ func (h *Handler) RegisterUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Check password policy
+	if err := h.Policy.Validate(req.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Check if user already exists
 	ctx := r.Context()
 	existingUser, err := h.Repo.GetUserByLogin(ctx, req.Login)
@@ -63,28 +118,33 @@ func (h *Handler) RegisterUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hashedPassword, err := h.Hasher.Hash(req.Password)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
 	// Create user
-	userID, err := h.Repo.CreateUser(ctx, req.Login, string(hashedPassword))
+	userID, err := h.Repo.CreateUser(ctx, req.Login, hashedPassword)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
+	h.audit(r, models.EventRegister, userID, nil)
+
 	// Generate token
-	token, err := middleware.GenerateToken(userID, h.JWTSecret)
+	token, err := h.JWT.GenerateToken(userID, models.RoleUser)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
 	// Set cookie and header
-	middleware.SetAuthCookie(w, token)
+	if err := middleware.SetAuthCookie(w, token, h.Cookies); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Authorization", "Bearer "+token)
 	w.WriteHeader(http.StatusOK)
 }
@@ -92,8 +152,10 @@ func (h *Handler) RegisterUser(w http.ResponseWriter, r *http.Request) {
 // LoginUser handles user login
 func (h *Handler) LoginUser(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Login    string `json:"login"`
-		Password string `json:"password"`
+		Login        string `json:"login"`
+		Password     string `json:"password"`
+		TOTPCode     string `json:"totp_code,omitempty"`
+		RecoveryCode string `json:"recovery_code,omitempty"`
 	}
 
 	// Parse request
@@ -107,35 +169,138 @@ func (h *Handler) LoginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get user
+	// Check brute-force protection. The attempt counts as failed until it
+	// succeeds or is released.
 	ctx := r.Context()
-	user, err := h.Repo.GetUserByLogin(ctx, req.Login)
+	ip := middleware.ClientIP(r)
+	retryAfter, err := h.LoginGuard.Attempt(ctx, req.Login, ip)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
-	if user == nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	if retryAfter > 0 {
+		h.audit(r, models.EventLoginFailure, 0, map[string]string{"login": req.Login, "reason": "locked"})
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, "Too many login attempts", http.StatusTooManyRequests)
 		return
 	}
 
-	// Check password
-	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password))
+	// Get user
+	user, err := h.Repo.GetUserByLogin(ctx, req.Login)
 	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Check password
+	var valid, needsRehash bool
+	if user != nil {
+		valid, needsRehash, err = h.Hasher.Verify(req.Password, user.PasswordHash)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if !valid {
+		var userID int64
+		if user != nil {
+			userID = user.ID
+		}
+		h.audit(r, models.EventLoginFailure, userID, map[string]string{"login": req.Login, "reason": "invalid_credentials"})
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
+	if user.DisabledAt != nil {
+		if err := h.LoginGuard.Release(ctx, req.Login, ip); err != nil {
+			logging.FromContext(ctx).Error("Error releasing login attempt", "login", req.Login, "error", err)
+		}
+		h.audit(r, models.EventLoginFailure, user.ID, map[string]string{"login": req.Login, "reason": "disabled"})
+		http.Error(w, "Account disabled", http.StatusForbidden)
+		return
+	}
+
+	// Check second factor
+	if user.TOTPEnabled {
+		err := h.TwoFactor.Verify(ctx, user, req.TOTPCode, req.RecoveryCode)
+		if errors.Is(err, service.ErrTwoFactorRequired) {
+			// The password was right; the client asks the user for the code
+			// and logs in again, so this is not a failed attempt
+			if err := h.LoginGuard.Release(ctx, req.Login, ip); err != nil {
+				logging.FromContext(ctx).Error("Error releasing login attempt", "login", req.Login, "error", err)
+			}
+			http.Error(w, "Two-factor code required", http.StatusUnauthorized)
+			return
+		}
+		if errors.Is(err, service.ErrInvalidTwoFactor) {
+			h.audit(r, models.EventLoginFailure, user.ID, map[string]string{"login": req.Login, "reason": "invalid_second_factor"})
+			http.Error(w, "Two-factor code required", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := h.LoginGuard.RecordSuccess(ctx, req.Login, ip); err != nil {
+		logging.FromContext(ctx).Error("Error resetting login attempts", "login", req.Login, "error", err)
+	}
+
+	// Upgrade outdated password hash
+	if needsRehash {
+		if hash, err := h.Hasher.Hash(req.Password); err != nil {
+			logging.FromContext(ctx).Error("Error rehashing password", "user_id", user.ID, "error", err)
+		} else if err := h.Repo.UpdateUserPasswordHash(ctx, user.ID, hash); err != nil {
+			logging.FromContext(ctx).Error("Error storing rehashed password", "user_id", user.ID, "error", err)
+		}
+	}
+
+	h.audit(r, models.EventLoginSuccess, user.ID, map[string]string{"method": "password"})
+
 	// Generate token
-	token, err := middleware.GenerateToken(user.ID, h.JWTSecret)
+	token, err := h.JWT.GenerateToken(user.ID, user.Role)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
 	// Set cookie and header
-	middleware.SetAuthCookie(w, token)
+	if err := middleware.SetAuthCookie(w, token, h.Cookies); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Authorization", "Bearer "+token)
+	w.WriteHeader(http.StatusOK)
+}
+
+// RefreshToken issues a new token with a full lifetime for the session the
+// request is authenticated with. The role is the user's current one, as
+// loaded by the auth middleware.
+func (h *Handler) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := middleware.GetUserID(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	role, _ := middleware.GetRole(r.Context())
+
+	token, err := h.JWT.GenerateToken(userID, role)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, models.EventTokenRefresh, userID, nil)
+
+	// Set cookie and header
+	if err := middleware.SetAuthCookie(w, token, h.Cookies); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Authorization", "Bearer "+token)
 	w.WriteHeader(http.StatusOK)
 }
@@ -157,15 +322,27 @@ func (h *Handler) UploadOrder(w http.ResponseWriter, r *http.Request) {
 	}
 
 	orderNumber := string(body)
-	if orderNumber == "" {
-		http.Error(w, "Empty order number", http.StatusBadRequest)
+	logging.AddAttrs(r.Context(), "order", orderNumber)
+
+	status, message := h.uploadOrder(r, userID, orderNumber)
+	if message != "" {
+		http.Error(w, message, status)
 		return
 	}
+	w.WriteHeader(status)
+}
+
+// uploadOrder stores an order number uploaded by the user and starts
+// processing it. It returns the response status and, for failures, the
+// error message. Shared by the HTTP and WebSocket APIs.
+func (h *Handler) uploadOrder(r *http.Request, userID int64, orderNumber string) (int, string) {
+	if orderNumber == "" {
+		return http.StatusBadRequest, "Empty order number"
+	}
 
 	// Validate order number with Luhn algorithm
 	if !utils.IsNumeric(orderNumber) || !utils.ValidateLuhn(orderNumber) {
-		http.Error(w, "Invalid order number format", http.StatusUnprocessableEntity)
-		return
+		return http.StatusUnprocessableEntity, "Invalid order number format"
 	}
 
 	ctx := r.Context()
@@ -173,33 +350,29 @@ func (h *Handler) UploadOrder(w http.ResponseWriter, r *http.Request) {
 	// Check if order already exists
 	existingOrder, err := h.Repo.GetOrderByNumber(ctx, orderNumber)
 	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
+		return http.StatusInternalServerError, "Server error"
 	}
 
 	// If order exists and belongs to this user, return 200
 	if existingOrder != nil && existingOrder.UserID == userID {
-		w.WriteHeader(http.StatusOK)
-		return
+		return http.StatusOK, ""
 	}
 
 	// If order exists but belongs to another user, return 409
 	if existingOrder != nil {
-		http.Error(w, "Order already uploaded by another user", http.StatusConflict)
-		return
+		return http.StatusConflict, "Order already uploaded by another user"
 	}
 
 	// Create order
 	err = h.Repo.CreateOrder(ctx, userID, orderNumber)
 	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
+		return http.StatusInternalServerError, "Server error"
 	}
 
-	// Start processing the order (in real implementation, this should be done in background)
-	go h.processOrder(orderNumber)
+	// The worker picks the order up from the database
+	h.audit(r, models.EventOrderUpload, userID, map[string]string{"order": orderNumber})
 
-	w.WriteHeader(http.StatusAccepted)
+	return http.StatusAccepted, ""
 }
 
 // GetOrders returns the list of user's orders
@@ -211,6 +384,10 @@ func (h *Handler) GetOrders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.notModified(w, r, userID) {
+		return
+	}
+
 	// Get orders
 	ctx := r.Context()
 	orders, err := h.Repo.GetUserOrders(ctx, userID)
@@ -225,28 +402,38 @@ func (h *Handler) GetOrders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Prepare response
-	type orderResponse struct {
-		Number     string    `json:"number"`
-		Status     string    `json:"status"`
-		Accrual    float64   `json:"accrual,omitempty"`
-		UploadedAt time.Time `json:"uploaded_at"`
+	writeOrders(w, orders)
+}
+
+// orderResponse is an order as returned to its owner
+type orderResponse struct {
+	Number     string    `json:"number"`
+	Status     string    `json:"status"`
+	Accrual    float64   `json:"accrual,omitempty"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// newOrderResponse prepares the response for an order
+func newOrderResponse(order models.Order) orderResponse {
+	orderResp := orderResponse{
+		Number:     order.Number,
+		Status:     order.Status,
+		UploadedAt: order.UploadedAt,
 	}
 
+	// Only include accrual if status is PROCESSED
+	if order.Status == models.StatusProcessed {
+		orderResp.Accrual = order.Accrual
+	}
+	return orderResp
+}
+
+// writeOrders writes the orders list response
+func writeOrders(w http.ResponseWriter, orders []models.Order) {
+	// Prepare response
 	response := make([]orderResponse, 0, len(orders))
 	for _, order := range orders {
-		orderResp := orderResponse{
-			Number:     order.Number,
-			Status:     order.Status,
-			UploadedAt: order.UploadedAt,
-		}
-
-		// Only include accrual if status is PROCESSED
-		if order.Status == models.StatusProcessed {
-			orderResp.Accrual = order.Accrual
-		}
-
-		response = append(response, orderResp)
+		response = append(response, newOrderResponse(order))
 	}
 
 	// Return orders
@@ -254,8 +441,9 @@ func (h *Handler) GetOrders(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// GetBalance returns user's balance
-func (h *Handler) GetBalance(w http.ResponseWriter, r *http.Request) {
+// GetOrder returns one of the user's orders. With ?wait= it waits for the
+// order to change, see pollResource.
+func (h *Handler) GetOrder(w http.ResponseWriter, r *http.Request) {
 	// Get user ID from context
 	userID, ok := middleware.GetUserID(r.Context())
 	if !ok {
@@ -263,17 +451,31 @@ func (h *Handler) GetBalance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get balance
-	ctx := r.Context()
-	balance, err := h.Repo.GetUserBalance(ctx, userID)
-	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
+	orderNumber := chi.URLParam(r, "number")
+	logging.AddAttrs(r.Context(), "order", orderNumber)
+
+	h.pollResource(w, r, userID, func(ctx context.Context) (interface{}, error) {
+		order, err := h.Repo.GetOrderByNumber(ctx, orderNumber)
+		if err != nil || order == nil || order.UserID != userID {
+			return nil, err
+		}
+		return newOrderResponse(*order), nil
+	})
+}
+
+// GetBalance returns user's balance. With ?wait= it waits for the balance
+// to change, see pollResource.
+func (h *Handler) GetBalance(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := middleware.GetUserID(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// Return balance
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(balance)
+	h.pollResource(w, r, userID, func(ctx context.Context) (interface{}, error) {
+		return h.Repo.GetUserBalance(ctx, userID)
+	})
 }
 
 // WithdrawBalance handles balance withdrawal
@@ -285,36 +487,97 @@ func (h *Handler) WithdrawBalance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req struct {
-		Order string  `json:"order"`
-		Sum   float64 `json:"sum"`
-	}
+	var req withdrawRequest
 
 	// Parse request
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
+	logging.AddAttrs(r.Context(), "order", req.Order)
 
+	status, message := h.withdraw(r, userID, req)
+	if message != "" {
+		http.Error(w, message, status)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// withdrawRequest is a request to pay for an order with points
+type withdrawRequest struct {
+	Order    string  `json:"order"`
+	Sum      float64 `json:"sum"`
+	TOTPCode string  `json:"totp_code,omitempty"`
+}
+
+// withdraw withdraws points from the user's balance. It returns the
+// response status and, for failures, the error message. Shared by the HTTP
+// and WebSocket APIs.
+func (h *Handler) withdraw(r *http.Request, userID int64, req withdrawRequest) (int, string) {
 	// Validate order number with Luhn algorithm
 	if !utils.IsNumeric(req.Order) || !utils.ValidateLuhn(req.Order) {
-		http.Error(w, "Invalid order number format", http.StatusUnprocessableEntity)
-		return
+		return http.StatusUnprocessableEntity, "Invalid order number format"
 	}
 
-	// Process withdrawal
 	ctx := r.Context()
+
+	// Require a fresh TOTP code for large withdrawals
+	if req.Sum > h.WithdrawTOTPThreshold {
+		user, err := h.Repo.GetUserByID(ctx, userID)
+		if err != nil || user == nil {
+			return http.StatusInternalServerError, "Server error"
+		}
+
+		if user.TOTPEnabled {
+			// A session is enough to guess codes here, so failures are
+			// counted per user like failed logins
+			retryAfter, err := h.LoginGuard.AttemptTOTP(ctx, userID)
+			if err != nil {
+				return http.StatusInternalServerError, "Server error"
+			}
+			if retryAfter > 0 {
+				return http.StatusTooManyRequests, "Too many two-factor attempts"
+			}
+
+			err = h.TwoFactor.Verify(ctx, user, req.TOTPCode, "")
+			if errors.Is(err, service.ErrTwoFactorRequired) {
+				if err := h.LoginGuard.ReleaseTOTP(ctx, userID); err != nil {
+					logging.FromContext(ctx).Error("Error releasing two-factor attempt", "error", err)
+				}
+				return http.StatusForbidden, "Two-factor code required"
+			}
+			if errors.Is(err, service.ErrInvalidTwoFactor) {
+				return http.StatusForbidden, "Two-factor code required"
+			}
+			if err != nil {
+				return http.StatusInternalServerError, "Server error"
+			}
+			if err := h.LoginGuard.RecordTOTPSuccess(ctx, userID); err != nil {
+				logging.FromContext(ctx).Error("Error resetting two-factor failures", "error", err)
+			}
+		}
+	}
+
+	// Process withdrawal
 	err := h.Repo.WithdrawBalance(ctx, userID, req.Order, req.Sum)
 	if err != nil {
 		if err.Error() == "insufficient funds" {
-			http.Error(w, "Insufficient funds", http.StatusPaymentRequired)
-			return
+			return http.StatusPaymentRequired, "Insufficient funds"
 		}
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
+		if errors.Is(err, repository.ErrOrderAlreadyWithdrawn) {
+			return http.StatusConflict, "Order has already been paid with points"
+		}
+		return http.StatusInternalServerError, "Server error"
 	}
 
-	w.WriteHeader(http.StatusOK)
+	h.audit(r, models.EventWithdrawal, userID, map[string]string{
+		"order": req.Order,
+		"sum":   strconv.FormatFloat(req.Sum, 'f', 2, 64),
+	})
+	metrics.ObserveWithdrawal(req.Sum)
+
+	return http.StatusOK, ""
 }
 
 // GetWithdrawals returns the list of user's withdrawals
@@ -326,6 +589,10 @@ func (h *Handler) GetWithdrawals(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.notModified(w, r, userID) {
+		return
+	}
+
 	// Get withdrawals
 	ctx := r.Context()
 	withdrawals, err := h.Repo.GetUserWithdrawals(ctx, userID)
@@ -340,6 +607,11 @@ func (h *Handler) GetWithdrawals(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	writeWithdrawals(w, withdrawals)
+}
+
+// writeWithdrawals writes the withdrawals list response
+func writeWithdrawals(w http.ResponseWriter, withdrawals []models.Withdrawal) {
 	// Prepare response
 	type withdrawalResponse struct {
 		Order       string    `json:"order"`
@@ -360,28 +632,3 @@ func (h *Handler) GetWithdrawals(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
-
-// processOrder processes an order in background
-func (h *Handler) processOrder(orderNumber string) {
-	// Create context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
-	defer cancel()
-
-	// Set initial status
-	err := h.Repo.UpdateOrderStatus(ctx, orderNumber, models.StatusProcessing, 0)
-	if err != nil {
-		return
-	}
-
-	// Get accrual from external service
-	accrualResp, err := h.AccrualSvc.GetOrderAccrual(ctx, orderNumber)
-	if err != nil || accrualResp == nil {
-		// If error or nil response, try again later (in real implementation)
-		return
-	}
-
-	// If status is final, update order
-	if accrualResp.Status == models.StatusProcessed || accrualResp.Status == models.StatusInvalid {
-		h.Repo.UpdateOrderStatus(ctx, orderNumber, accrualResp.Status, accrualResp.Accrual)
-	}
-}
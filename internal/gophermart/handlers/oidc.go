@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/middleware"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/service"
+)
+
+const (
+	// oidcStateCookieName holds the signed OIDC state between login and
+	// callback
+	oidcStateCookieName = "oidc_state"
+	// oidcTwoFactorCookieName holds the signed two-factor challenge between
+	// callback and second factor
+	oidcTwoFactorCookieName = "oidc_2fa"
+	// oidcCookiePath limits the OIDC cookies to the OIDC routes
+	oidcCookiePath = "/api/user/oidc"
+)
+
+// OIDCLogin redirects the user to the identity provider
+func (h *Handler) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	authURL, signedState, err := h.OIDC.Begin()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error starting OIDC login", "error", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	// SameSite=Lax lets the cookie come back with the provider's redirect
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    signedState,
+		Path:     oidcCookiePath,
+		Domain:   h.Cookies.Domain,
+		HttpOnly: true,
+		Secure:   h.Cookies.Secure || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback completes the login started by OIDCLogin and issues the
+// same token as LoginUser. Users with two-factor authentication get a
+// challenge cookie instead and finish with OIDCTwoFactor.
+func (h *Handler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if errParam := r.URL.Query().Get("error"); errParam != "" {
+		http.Error(w, "Login failed: "+errParam, http.StatusUnauthorized)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil {
+		http.Error(w, "Missing login state", http.StatusBadRequest)
+		return
+	}
+
+	// The state cookie is single use
+	http.SetCookie(w, &http.Cookie{
+		Name:   oidcStateCookieName,
+		Path:   oidcCookiePath,
+		MaxAge: -1,
+	})
+
+	ctx := r.Context()
+	user, err := h.OIDC.Finish(ctx, r.URL.Query().Get("code"), r.URL.Query().Get("state"), cookie.Value)
+	if errors.Is(err, service.ErrInvalidOIDCState) || errors.Is(err, service.ErrInvalidIDToken) {
+		http.Error(w, "Invalid login response", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("Error completing OIDC login", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if user.DisabledAt != nil {
+		http.Error(w, "Account disabled", http.StatusForbidden)
+		return
+	}
+
+	// The provider only stands in for the password; the second factor is
+	// still ours to check
+	if user.TOTPEnabled {
+		challenge, err := h.OIDC.BeginTwoFactor(user.ID)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcTwoFactorCookieName,
+			Value:    challenge,
+			Path:     oidcCookiePath,
+			Domain:   h.Cookies.Domain,
+			HttpOnly: true,
+			Secure:   h.Cookies.Secure || r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Error(w, "Two-factor code required", http.StatusUnauthorized)
+		return
+	}
+
+	h.completeOIDCLogin(w, r, user)
+}
+
+// OIDCTwoFactor checks the second factor of a user signed in by
+// OIDCCallback and issues the same token as LoginUser. Failures count
+// towards the login lockout of the user's login.
+func (h *Handler) OIDCTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TOTPCode     string `json:"totp_code,omitempty"`
+		RecoveryCode string `json:"recovery_code,omitempty"`
+	}
+
+	// Parse request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcTwoFactorCookieName)
+	if err != nil {
+		http.Error(w, "Missing login state", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := h.OIDC.FinishTwoFactor(cookie.Value)
+	if err != nil {
+		http.Error(w, "Invalid login state", http.StatusUnauthorized)
+		return
+	}
+
+	ctx := r.Context()
+	user, err := h.Repo.GetUserByID(ctx, userID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		http.Error(w, "Invalid login state", http.StatusUnauthorized)
+		return
+	}
+	if user.DisabledAt != nil {
+		http.Error(w, "Account disabled", http.StatusForbidden)
+		return
+	}
+
+	// Check brute-force protection. The attempt counts as failed until it
+	// succeeds or is released.
+	ip := middleware.ClientIP(r)
+	retryAfter, err := h.LoginGuard.Attempt(ctx, user.Login, ip)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if retryAfter > 0 {
+		h.audit(r, models.EventLoginFailure, user.ID, map[string]string{"login": user.Login, "reason": "locked"})
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, "Too many login attempts", http.StatusTooManyRequests)
+		return
+	}
+
+	err = h.TwoFactor.Verify(ctx, user, req.TOTPCode, req.RecoveryCode)
+	if errors.Is(err, service.ErrTwoFactorRequired) {
+		if err := h.LoginGuard.Release(ctx, user.Login, ip); err != nil {
+			logging.FromContext(ctx).Error("Error releasing login attempt", "login", user.Login, "error", err)
+		}
+		http.Error(w, "Two-factor code required", http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, service.ErrInvalidTwoFactor) {
+		h.audit(r, models.EventLoginFailure, user.ID, map[string]string{"login": user.Login, "reason": "invalid_second_factor"})
+		http.Error(w, "Two-factor code required", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.LoginGuard.RecordSuccess(ctx, user.Login, ip); err != nil {
+		logging.FromContext(ctx).Error("Error resetting login attempts", "login", user.Login, "error", err)
+	}
+
+	// The challenge is single use
+	http.SetCookie(w, &http.Cookie{
+		Name:   oidcTwoFactorCookieName,
+		Path:   oidcCookiePath,
+		MaxAge: -1,
+	})
+
+	h.completeOIDCLogin(w, r, user)
+}
+
+// completeOIDCLogin issues the token of a user signed in with OIDC
+func (h *Handler) completeOIDCLogin(w http.ResponseWriter, r *http.Request, user *models.User) {
+	h.audit(r, models.EventLoginSuccess, user.ID, map[string]string{"method": "oidc"})
+
+	// Generate token
+	token, err := h.JWT.GenerateToken(user.ID, user.Role)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Set cookie and header
+	if err := middleware.SetAuthCookie(w, token, h.Cookies); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Authorization", "Bearer "+token)
+	w.WriteHeader(http.StatusOK)
+}
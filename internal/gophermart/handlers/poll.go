@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
+)
+
+const (
+	// resourceVersionHeader carries the data version the resource was
+	// loaded at, for the since parameter of the next long poll
+	resourceVersionHeader = "Resource-Version"
+	// maxPollWait caps the wait parameter
+	maxPollWait = time.Minute
+	// pollTimeoutMargin keeps a long poll this far from the request timeout
+	// so that it answers before the timeout middleware does
+	pollTimeoutMargin = 5 * time.Second
+)
+
+// pollResource writes the resource returned by load, or 404 if it returns
+// nil. The Resource-Version header carries the user's data version, which
+// the ETag is derived from as well, so If-None-Match gets 304 as on the
+// other routes.
+//
+// With ?wait=<duration>, the response is held until the data version
+// differs from ?since=<version> or the wait is over, whichever comes first;
+// the resource is then written as usual, changed or not. Any event of the
+// user wakes the request up to check the version again. As the version is
+// per user, a change to another of the user's resources ends the wait
+// too. The wait is capped below the request timeout, and the request ends
+// without a response if the client goes away.
+func (h *Handler) pollResource(w http.ResponseWriter, r *http.Request, userID int64, load func(ctx context.Context) (interface{}, error)) {
+	var wait time.Duration
+	if param := r.URL.Query().Get("wait"); param != "" {
+		d, err := time.ParseDuration(param)
+		if err != nil || d < 0 {
+			http.Error(w, "Invalid wait", http.StatusBadRequest)
+			return
+		}
+		wait = d
+		if limit := h.pollWaitLimit(); wait > limit {
+			wait = limit
+		}
+	}
+	since := r.URL.Query().Get("since")
+
+	ctx := r.Context()
+	var expired <-chan time.Time
+	var changed <-chan struct{}
+	if wait > 0 {
+		// Subscribe before reading the version so that no change falls
+		// between
+		sub := h.Events.Subscribe(userID)
+		defer sub.Close()
+		changed = sub.C
+
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	// The version is read once more after the wait is over, so the
+	// response is current
+	final := wait == 0
+	for {
+		// Read before the resource, like the ETag: if the data changes in
+		// between, the response is newer than its version and the next
+		// poll simply gets it again
+		version, err := h.Repo.GetUserDataVersion(ctx, userID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logging.FromContext(ctx).Error("Error reading data version", "error", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		if final || strconv.FormatInt(version, 10) != since {
+			h.writeResource(w, r, userID, version, load)
+			return
+		}
+
+		select {
+		case _, ok := <-changed:
+			// The subscription is closed when the server is shutting down
+			final = !ok
+		case <-expired:
+			final = true
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// writeResource loads the resource and writes it with the data version it
+// was loaded at
+func (h *Handler) writeResource(w http.ResponseWriter, r *http.Request, userID, version int64, load func(ctx context.Context) (interface{}, error)) {
+	ctx := r.Context()
+	resource, err := load(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		logging.FromContext(ctx).Error("Error loading resource", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if resource == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set(resourceVersionHeader, strconv.FormatInt(version, 10))
+	if notModifiedSince(w, r, userID, version) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resource)
+}
+
+// pollWaitLimit returns the longest wait allowed for a long poll
+func (h *Handler) pollWaitLimit() time.Duration {
+	limit := h.RequestTimeout - pollTimeoutMargin
+	if limit < h.RequestTimeout/2 {
+		limit = h.RequestTimeout / 2
+	}
+	if limit > maxPollWait {
+		limit = maxPollWait
+	}
+	return limit
+}
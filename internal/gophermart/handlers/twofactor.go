@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/middleware"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/service"
+)
+
+// EnrollTwoFactor starts TOTP enrollment and returns the secret
+func (h *Handler) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := middleware.GetUserID(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ctx := r.Context()
+	user, err := h.Repo.GetUserByID(ctx, userID)
+	if err != nil || user == nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	secret, uri, err := h.TwoFactor.Enroll(ctx, user)
+	if errors.Is(err, service.ErrTwoFactorEnabled) {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+	}{
+		Secret: secret,
+		URI:    uri,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ConfirmTwoFactor enables TOTP after checking the first code and returns
+// recovery codes
+func (h *Handler) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := middleware.GetUserID(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+
+	// Parse request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	user, err := h.Repo.GetUserByID(ctx, userID)
+	if err != nil || user == nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := h.TwoFactor.Confirm(ctx, user, req.Code)
+	switch {
+	case errors.Is(err, service.ErrTwoFactorEnabled):
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	case errors.Is(err, service.ErrTwoFactorNotStarted):
+		http.Error(w, "Two-factor enrollment has not been started", http.StatusConflict)
+		return
+	case errors.Is(err, service.ErrInvalidTwoFactor):
+		http.Error(w, "Invalid two-factor code", http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, models.EventTwoFactorEnabled, userID, nil)
+
+	response := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		RecoveryCodes: codes,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// DisableTwoFactor turns TOTP off after checking a TOTP or recovery code
+func (h *Handler) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := middleware.GetUserID(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	// Parse request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	user, err := h.Repo.GetUserByID(ctx, userID)
+	if err != nil || user == nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Failed codes count towards the same lockout as those of withdrawals
+	retryAfter, err := h.LoginGuard.AttemptTOTP(ctx, userID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, "Too many two-factor attempts", http.StatusTooManyRequests)
+		return
+	}
+
+	err = h.TwoFactor.Disable(ctx, user, req.Code, req.RecoveryCode)
+	if errors.Is(err, service.ErrTwoFactorNotEnabled) || errors.Is(err, service.ErrTwoFactorRequired) {
+		// No code was checked, so the attempt doesn't count
+		if err := h.LoginGuard.ReleaseTOTP(ctx, userID); err != nil {
+			logging.FromContext(ctx).Error("Error releasing two-factor attempt", "error", err)
+		}
+	}
+	switch {
+	case errors.Is(err, service.ErrTwoFactorNotEnabled):
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+		return
+	case errors.Is(err, service.ErrTwoFactorRequired):
+		http.Error(w, "Two-factor code required", http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, service.ErrInvalidTwoFactor):
+		http.Error(w, "Invalid two-factor code", http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.LoginGuard.RecordTOTPSuccess(ctx, userID); err != nil {
+		logging.FromContext(ctx).Error("Error resetting two-factor failures", "error", err)
+	}
+
+	h.audit(r, models.EventTwoFactorDisabled, userID, nil)
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,376 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/middleware"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/service"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsWriteTimeout is how long writing a message may take before the
+	// client is considered too slow and disconnected
+	wsWriteTimeout = 10 * time.Second
+	// wsPongTimeout is how long the client may stay silent, pongs included
+	wsPongTimeout = 60 * time.Second
+	// wsPingInterval is how often the server pings; shorter than
+	// wsPongTimeout so that a live client always answers in time
+	wsPingInterval = 25 * time.Second
+	// wsMaxMessageSize limits the size of client messages
+	wsMaxMessageSize = 4096
+	// wsSendQueueSize is the number of messages waiting to be written.
+	// Producers block when it is full, so a slow client slows down its own
+	// requests and events rather than buffering them without bound.
+	wsSendQueueSize = 16
+	// wsRequestTimeout limits the handling of a single client message
+	wsRequestTimeout = 30 * time.Second
+)
+
+// WebSocket message types
+const (
+	wsTypeUploadOrder = "upload_order"
+	wsTypeWithdraw    = "withdraw"
+	wsTypeError       = "error"
+)
+
+// wsUpgrader upgrades connections. Its default origin check rejects pages
+// from other origins, which could otherwise connect with the user's auth
+// cookie.
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// wsRequest is a message sent by the client. The fields used depend on the
+// type: upload_order takes the order, withdraw takes the order, the sum and
+// optionally the TOTP code.
+type wsRequest struct {
+	Type string `json:"type"`
+	// ID is echoed in the reply so that the client can match them
+	ID       string  `json:"id,omitempty"`
+	Order    string  `json:"order"`
+	Sum      float64 `json:"sum"`
+	TOTPCode string  `json:"totp_code,omitempty"`
+}
+
+// wsMessage is a message sent by the server: a reply to a request, with the
+// status code the HTTP API would have returned, or a user event
+type wsMessage struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Status  int             `json:"status,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	EventID int64           `json:"event_id,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// wsSession is a WebSocket connection of a user
+type wsSession struct {
+	h      *Handler
+	conn   *websocket.Conn
+	r      *http.Request
+	userID int64
+	send   chan wsMessage
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// expired fires when the credentials of the connection expire; nil if
+	// they don't
+	expired <-chan time.Time
+
+	stopOnce sync.Once
+	closeMsg []byte
+}
+
+// ServeWebSocket lets clients upload orders and withdraw points over a
+// WebSocket connection, which also carries the order status and balance
+// changes of the user as they happen
+func (h *Handler) ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := middleware.GetUserID(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Subscribe before reading the latest event so that no event falls
+	// between
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	sub := h.Events.Subscribe(userID)
+	defer sub.Close()
+
+	lastID, err := h.Repo.GetLatestUserEventID(ctx, userID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Upgrade replies to the client itself on failure
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	s := &wsSession{
+		h:      h,
+		conn:   conn,
+		r:      r.WithContext(ctx),
+		userID: userID,
+		send:   make(chan wsMessage, wsSendQueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	if expiresAt, ok := middleware.GetExpiresAt(ctx); ok {
+		timer := time.NewTimer(time.Until(expiresAt))
+		defer timer.Stop()
+		s.expired = timer.C
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.readRequests()
+	}()
+	go func() {
+		defer wg.Done()
+		s.pumpEvents(sub, lastID)
+	}()
+
+	s.writeMessages()
+
+	// Closing the connection unblocks the reader
+	s.stop(nil)
+	conn.Close()
+	wg.Wait()
+}
+
+// stop ends the session. The close message is sent to the client unless it
+// is nil; only the first call counts.
+func (s *wsSession) stop(closeMsg []byte) {
+	s.stopOnce.Do(func() {
+		s.closeMsg = closeMsg
+		s.cancel()
+	})
+}
+
+// enqueue queues a message for writing, waiting for room in the queue. It
+// returns false if the session has ended.
+func (s *wsSession) enqueue(msg wsMessage) bool {
+	select {
+	case s.send <- msg:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// writeMessages writes queued messages and pings until the session ends.
+// It is the only writer of data messages on the connection. The
+// credentials are rechecked with every ping, so that a disabled user or a
+// revoked API key stops receiving events too.
+func (s *wsSession) writeMessages() {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case msg := <-s.send:
+			s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := s.conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-s.expired:
+			// The client reconnects with fresh credentials
+			s.stop(websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Credentials expired"))
+		case <-ping.C:
+			if status, _ := s.revalidate(); status == http.StatusUnauthorized {
+				// The session has been stopped; the close message is sent
+				// next
+				continue
+			}
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		case <-s.ctx.Done():
+			if s.closeMsg != nil {
+				s.conn.WriteControl(websocket.CloseMessage, s.closeMsg, time.Now().Add(wsWriteTimeout))
+			}
+			return
+		}
+	}
+}
+
+// readRequests handles client messages one at a time, so a client sending
+// faster than it reads the replies ends up waiting for them
+func (s *wsSession) readRequests() {
+	s.conn.SetReadLimit(wsMaxMessageSize)
+	s.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			// The client has closed the connection or is gone; the
+			// connection already replied to a close or oversized message
+			s.stop(nil)
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+
+		if !s.enqueue(s.handle(data)) {
+			return
+		}
+	}
+}
+
+// handle handles a client message and returns the reply
+func (s *wsSession) handle(data []byte) wsMessage {
+	var req wsRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return wsMessage{Type: wsTypeError, Error: "Invalid message"}
+	}
+
+	var status int
+	var message string
+	switch req.Type {
+	case wsTypeUploadOrder:
+		status, message = s.uploadOrder(req)
+	case wsTypeWithdraw:
+		status, message = s.withdraw(req)
+	default:
+		return wsMessage{Type: wsTypeError, ID: req.ID, Error: "Unknown message type"}
+	}
+
+	return wsMessage{Type: req.Type, ID: req.ID, Status: status, Error: message}
+}
+
+// uploadOrder handles an upload_order message with the checks the HTTP
+// route applies
+func (s *wsSession) uploadOrder(req wsRequest) (int, string) {
+	if !middleware.HasScope(s.ctx, models.ScopeOrdersWrite) {
+		return http.StatusForbidden, "Insufficient scope"
+	}
+	if status, message := s.revalidate(); status != 0 {
+		return status, message
+	}
+	if !s.allow(middleware.RateLimitGroupAPI) || !s.allow(middleware.RateLimitGroupOrders) {
+		return http.StatusTooManyRequests, "Too many requests"
+	}
+
+	r, cancel := s.request()
+	defer cancel()
+	return s.h.uploadOrder(r, s.userID, req.Order)
+}
+
+// withdraw handles a withdraw message with the checks the HTTP route
+// applies
+func (s *wsSession) withdraw(req wsRequest) (int, string) {
+	if !middleware.HasScope(s.ctx, models.ScopeBalanceWithdraw) {
+		return http.StatusForbidden, "Insufficient scope"
+	}
+	if status, message := s.revalidate(); status != 0 {
+		return status, message
+	}
+	if !s.allow(middleware.RateLimitGroupAPI) {
+		return http.StatusTooManyRequests, "Too many requests"
+	}
+
+	r, cancel := s.request()
+	defer cancel()
+	return s.h.withdraw(r, s.userID, withdrawRequest{
+		Order:    req.Order,
+		Sum:      req.Sum,
+		TOTPCode: req.TOTPCode,
+	})
+}
+
+// revalidate checks that the credentials the connection was opened with are
+// still good, before a state-changing message and on every ping. If they
+// have expired, the user has been disabled or the API key revoked since,
+// the connection is closed. It returns a zero status if the session may
+// go on.
+func (s *wsSession) revalidate() (int, string) {
+	if expiresAt, ok := middleware.GetExpiresAt(s.ctx); ok && !time.Now().Before(expiresAt) {
+		s.stop(websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Credentials expired"))
+		return http.StatusUnauthorized, "Unauthorized"
+	}
+
+	valid, err := s.h.JWT.Revalidate(s.ctx)
+	if err != nil {
+		logging.FromContext(s.ctx).Error("Error revalidating credentials", "error", err)
+		return http.StatusInternalServerError, "Server error"
+	}
+	if !valid {
+		s.stop(websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Credentials revoked"))
+		return http.StatusUnauthorized, "Unauthorized"
+	}
+	return 0, ""
+}
+
+// request returns the upgrade request with a context limited to the
+// handling of one message
+func (s *wsSession) request() (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(s.ctx, wsRequestTimeout)
+	return s.r.WithContext(ctx), cancel
+}
+
+// allow takes a rate limit token for the user in the route group. If the
+// limiter fails, the message is let through.
+func (s *wsSession) allow(group string) bool {
+	decision, err := s.h.RateLimiter.Allow(s.ctx, group, middleware.UserRateLimitKey(s.userID))
+	if err != nil {
+		logging.FromContext(s.ctx).Error("Error checking rate limit", "group", group, "error", err)
+		return true
+	}
+	return decision == nil || decision.Allowed
+}
+
+// pumpEvents queues the user's events as they are added
+func (s *wsSession) pumpEvents(sub *service.EventSubscription, lastID int64) {
+	for {
+		// Send everything after the last event sent
+		for {
+			events, err := s.h.Repo.GetUserEvents(s.ctx, s.userID, lastID, eventsBatchSize)
+			if err != nil {
+				if s.ctx.Err() == nil {
+					logging.FromContext(s.ctx).Error("Error getting user events", "error", err)
+					s.stop(websocket.FormatCloseMessage(websocket.CloseInternalServerErr, ""))
+				}
+				return
+			}
+			for _, e := range events {
+				if !s.enqueue(wsMessage{Type: e.Type, EventID: e.ID, Data: e.Data}) {
+					return
+				}
+				lastID = e.ID
+			}
+			if len(events) < eventsBatchSize {
+				break
+			}
+		}
+
+		select {
+		case _, ok := <-sub.C:
+			if !ok {
+				// The server is shutting down; the client reconnects
+				s.stop(websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server is shutting down"))
+				return
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// level is shared by every logger created here so that it can be changed
+// at runtime
+var level = new(slog.LevelVar)
+
+// Setup makes a JSON logger with the given level the default. Output of
+// the standard log package is routed through it as well.
+func Setup(levelName string) error {
+	if err := SetLevel(levelName); err != nil {
+		return err
+	}
+	slog.SetDefault(New(os.Stderr))
+	return nil
+}
+
+// New returns a JSON logger that redacts secrets and uses the shared level
+func New(w io.Writer) *slog.Logger {
+	opts := slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redactAttr,
+	}
+	return slog.New(&redactingHandler{next: opts.NewJSONHandler(w)})
+}
+
+// SetLevel changes the level of every logger: debug, info, warn or error
+func SetLevel(name string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.ToUpper(name))); err != nil {
+		return fmt.Errorf("unknown log level %q", name)
+	}
+	level.Set(l)
+	return nil
+}
+
+// ValidLevel reports whether name is a level accepted by SetLevel
+func ValidLevel(name string) bool {
+	var l slog.Level
+	return l.UnmarshalText([]byte(strings.ToUpper(name))) == nil
+}
+
+// scope holds the logger of a request or background job. Attributes added
+// with AddAttrs are seen by everything sharing the context, including the
+// access log written when the request completes.
+type scope struct {
+	logger *slog.Logger
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying its own logger scope
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, &scope{logger: logger})
+}
+
+// FromContext returns the logger of the context, or the default logger
+func FromContext(ctx context.Context) *slog.Logger {
+	if s, ok := ctx.Value(contextKey{}).(*scope); ok {
+		return s.logger
+	}
+	return slog.Default()
+}
+
+// AddAttrs adds attributes to the logger of the context scope. It does
+// nothing if the context has no scope.
+func AddAttrs(ctx context.Context, args ...any) {
+	if s, ok := ctx.Value(contextKey{}).(*scope); ok {
+		s.logger = s.logger.With(args...)
+	}
+}
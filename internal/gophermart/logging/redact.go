@@ -0,0 +1,115 @@
+package logging
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// redacted replaces secret values
+const redacted = "REDACTED"
+
+// sensitiveKeys are attribute key fragments whose values are never logged
+var sensitiveKeys = []string{
+	"password", "passwd", "secret", "token", "authorization",
+	"cookie", "api_key", "apikey", "recovery_code", "totp",
+}
+
+// sensitiveHeaders are HTTP headers whose values are never logged
+var sensitiveHeaders = []string{
+	"Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "X-Csrf-Token",
+}
+
+// secretPatterns match secrets embedded in free text such as error
+// messages: bearer tokens, JWTs, API keys and password parameters
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(bearer\s+)\S+`),
+	regexp.MustCompile(`eyJ[\w-]+\.[\w-]+\.[\w-]*`),
+	regexp.MustCompile(`gm_[0-9a-f]{8}_[0-9a-f]+`),
+	regexp.MustCompile(`(?i)(password[=:]\s*)\S+`),
+	regexp.MustCompile(`(://[^:/@\s]+:)[^@\s]+(@)`),
+}
+
+// redactString hides secrets found in s
+func redactString(s string) string {
+	for _, p := range secretPatterns {
+		switch p.NumSubexp() {
+		case 2:
+			s = p.ReplaceAllString(s, "${1}"+redacted+"${2}")
+		case 1:
+			s = p.ReplaceAllString(s, "${1}"+redacted)
+		default:
+			s = p.ReplaceAllString(s, redacted)
+		}
+	}
+	return s
+}
+
+// isSensitiveKey reports whether values under key must be hidden
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, k := range sensitiveKeys {
+		if strings.Contains(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactAttr hides sensitive attributes before they are written
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	if isSensitiveKey(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redactString(a.Value.String()))
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case http.Header:
+			return slog.Any(a.Key, redactHeader(v))
+		case error:
+			return slog.String(a.Key, redactString(v.Error()))
+		}
+	}
+
+	return a
+}
+
+// redactHeader returns a copy of h with sensitive headers hidden
+func redactHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range sensitiveHeaders {
+		if _, ok := out[name]; ok {
+			out[name] = []string{redacted}
+		}
+	}
+	return out
+}
+
+// redactingHandler hides secrets in log messages. Attributes are handled
+// by redactAttr.
+type redactingHandler struct {
+	next slog.Handler
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return h.next.Enabled(ctx, l)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	r.Message = redactString(r.Message)
+	return h.next.Handle(ctx, r)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &redactingHandler{next: h.next.WithAttrs(attrs)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: h.next.WithGroup(name)}
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	chiMiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace prefixes every metric name
+const namespace = "gophermart"
+
+// Accrual request outcomes
+const (
+	AccrualOK          = "200"
+	AccrualNoContent   = "204"
+	AccrualRateLimited = "429"
+	AccrualServerError = "5xx"
+	AccrualTimeout     = "timeout"
+	AccrualError       = "error"
+	AccrualOther       = "other"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route pattern and status code.",
+	}, []string{"method", "route", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method and route pattern.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	accrualRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "accrual_requests_total",
+		Help:      "Requests to the accrual system by outcome.",
+	}, []string{"outcome"})
+
+	withdrawals = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "withdrawals_total",
+		Help:      "Successful withdrawals.",
+	})
+
+	withdrawnPoints = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "withdrawn_points_total",
+		Help:      "Points spent in successful withdrawals.",
+	})
+)
+
+// Handler serves the metrics in Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware records request counts and latency per chi route pattern
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := chiMiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		// The pattern is only known once the router has matched the route.
+		// Unmatched requests share one label to bound cardinality.
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// ObserveAccrualRequest counts a request to the accrual system
+func ObserveAccrualRequest(outcome string) {
+	accrualRequests.WithLabelValues(outcome).Inc()
+}
+
+// ObserveWithdrawal counts a successful withdrawal
+func ObserveWithdrawal(sum float64) {
+	withdrawals.Inc()
+	withdrawnPoints.Add(sum)
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/exp/slog"
+)
+
+// storeScrapeTimeout bounds the queries made on each scrape
+const storeScrapeTimeout = 5 * time.Second
+
+var (
+	dbOpenConnections = prometheus.NewDesc(namespace+"_db_open_connections", "Open database connections, in use and idle.", nil, nil)
+	dbInUse           = prometheus.NewDesc(namespace+"_db_in_use_connections", "Database connections currently in use.", nil, nil)
+	dbIdle            = prometheus.NewDesc(namespace+"_db_idle_connections", "Idle database connections.", nil, nil)
+	dbMaxOpen         = prometheus.NewDesc(namespace+"_db_max_open_connections", "Maximum number of open database connections, 0 if unlimited.", nil, nil)
+	dbWaitCount       = prometheus.NewDesc(namespace+"_db_wait_count_total", "Total connections waited for.", nil, nil)
+	dbWaitDuration    = prometheus.NewDesc(namespace+"_db_wait_duration_seconds_total", "Total time blocked waiting for a connection.", nil, nil)
+	ordersByStatus    = prometheus.NewDesc(namespace+"_orders", "Orders by status.", []string{"status"}, nil)
+	workerLag         = prometheus.NewDesc(namespace+"_worker_lag_seconds", "Age of the oldest order waiting for accrual, 0 if none.", nil, nil)
+)
+
+// storeCollector reads database pool stats and order counts on each scrape
+type storeCollector struct {
+	repo repository.Repository
+}
+
+// RegisterStore registers the database and order metrics
+func RegisterStore(repo repository.Repository) error {
+	return prometheus.Register(&storeCollector{repo: repo})
+}
+
+// Describe implements prometheus.Collector
+func (c *storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		dbOpenConnections, dbInUse, dbIdle, dbMaxOpen, dbWaitCount, dbWaitDuration,
+		ordersByStatus, workerLag,
+	} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *storeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collectPool(ch, c.repo.Stats())
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeScrapeTimeout)
+	defer cancel()
+
+	stats, err := c.repo.GetOrderStats(ctx)
+	if err != nil {
+		slog.Error("Error collecting order metrics", "error", err)
+		return
+	}
+
+	for status, count := range stats.CountByStatus {
+		ch <- prometheus.MustNewConstMetric(ordersByStatus, prometheus.GaugeValue, float64(count), status)
+	}
+
+	lag := 0.0
+	if stats.OldestPending != nil {
+		lag = time.Since(*stats.OldestPending).Seconds()
+	}
+	ch <- prometheus.MustNewConstMetric(workerLag, prometheus.GaugeValue, lag)
+}
+
+func (c *storeCollector) collectPool(ch chan<- prometheus.Metric, s sql.DBStats) {
+	ch <- prometheus.MustNewConstMetric(dbOpenConnections, prometheus.GaugeValue, float64(s.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(dbInUse, prometheus.GaugeValue, float64(s.InUse))
+	ch <- prometheus.MustNewConstMetric(dbIdle, prometheus.GaugeValue, float64(s.Idle))
+	ch <- prometheus.MustNewConstMetric(dbMaxOpen, prometheus.GaugeValue, float64(s.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(dbWaitCount, prometheus.CounterValue, float64(s.WaitCount))
+	ch <- prometheus.MustNewConstMetric(dbWaitDuration, prometheus.CounterValue, s.WaitDuration.Seconds())
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/service"
+	"github.com/go-chi/chi/v5"
+	chiMiddleware "github.com/go-chi/chi/v5/middleware"
+)
+
+// NewAuditEvent creates an audit event carrying the request's client IP,
+// user agent and request ID
+func NewAuditEvent(r *http.Request, eventType string, userID int64, details map[string]string) models.AuditEvent {
+	return models.AuditEvent{
+		UserID:    userID,
+		Type:      eventType,
+		IP:        ClientIP(r),
+		UserAgent: r.UserAgent(),
+		RequestID: chiMiddleware.GetReqID(r.Context()),
+		Details:   details,
+	}
+}
+
+// ClientIP returns the client address, as set by the RealIP middleware
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// AdminAudit creates middleware that records every request made to admin
+// routes together with the acting user and the response status
+func AdminAudit(audit *service.AuditService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ww := chiMiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+
+			userID, _ := GetUserID(r.Context())
+			role, _ := GetRole(r.Context())
+			audit.Record(r.Context(), NewAuditEvent(r, models.EventAdminAction, userID, map[string]string{
+				"role":   role,
+				"action": r.Method + " " + chi.RouteContext(r.Context()).RoutePattern(),
+				"path":   r.URL.Path,
+				"status": strconv.Itoa(ww.Status()),
+			}))
+		})
+	}
+}
@@ -3,11 +3,15 @@ package middleware
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
 	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/service"
 	"github.com/golang-jwt/jwt/v4"
 )
 
@@ -16,110 +20,329 @@ type contextKey string
 const (
 	// UserIDKey is the key for user ID in the request context
 	UserIDKey contextKey = "userID"
+	// ScopesKey is the key for API key scopes in the request context.
+	// It is only set for requests authenticated with an API key.
+	ScopesKey contextKey = "scopes"
+	// RoleKey is the key for user role in the request context
+	RoleKey contextKey = "role"
+	// ExpiresAtKey is the key for the expiry of the request's token or API
+	// key in the request context. It is not set for keys that don't expire.
+	ExpiresAtKey contextKey = "expiresAt"
+	// APIKeyIDKey is the key for the ID of the API key in the request
+	// context. It is only set for requests authenticated with an API key.
+	APIKeyIDKey contextKey = "apiKeyID"
 	// Authentication-related constants
-	jwtExpirationTime = 24 * time.Hour
-	authCookieName    = "auth_token"
-	bearerSchema      = "Bearer "
+	authCookieName = "auth_token"
+	bearerSchema   = "Bearer "
+	apiKeyHeader   = "X-API-Key"
 )
 
-// JWTConfig contains configuration for JWT authentication
+// tokenKind tells how the request presented its credentials
+type tokenKind int
+
+const (
+	tokenNone tokenKind = iota
+	tokenJWT
+	tokenCookie
+	tokenAPIKey
+)
+
+// JWTConfig contains configuration for JWT authentication. Tokens are
+// signed with SecretKey; tokens signed with one of PreviousKeys are still
+// accepted. The keys may be replaced at runtime with SetKeys.
 type JWTConfig struct {
-	SecretKey string
-	Repo      repository.Repository
+	SecretKey    string
+	PreviousKeys []string
+	TokenTTL     time.Duration
+	Repo         repository.Repository
+	APIKeys      *service.APIKeyService
+
+	mu sync.RWMutex
+}
+
+// SetKeys replaces the signing key and the previous keys accepted for
+// verification
+func (c *JWTConfig) SetKeys(secretKey string, previousKeys []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.SecretKey = secretKey
+	c.PreviousKeys = previousKeys
+}
+
+// signingKey returns the current signing key
+func (c *JWTConfig) signingKey() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.SecretKey
+}
+
+// verificationKeys returns every key a valid token may be signed with,
+// current key first
+func (c *JWTConfig) verificationKeys() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return append([]string{c.SecretKey}, c.PreviousKeys...)
 }
 
 // JWTClaims represents JWT claims
 type JWTClaims struct {
-	UserID int64 `json:"user_id"`
+	UserID int64  `json:"user_id"`
+	Role   string `json:"role,omitempty"`
 	jwt.RegisteredClaims
 }
 
 // GenerateToken generates a JWT token for a user
-func GenerateToken(userID int64, secretKey string) (string, error) {
+func (c *JWTConfig) GenerateToken(userID int64, role string) (string, error) {
 	claims := JWTClaims{
 		UserID: userID,
+		Role:   role,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(jwtExpirationTime)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(c.TokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secretKey))
+	return token.SignedString([]byte(c.signingKey()))
 }
 
 // AuthMiddleware creates middleware that checks if the user is authenticated
 func AuthMiddleware(jwtConfig *JWTConfig) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Extract token from Authorization header or cookie
-			tokenString := extractToken(r)
-			if tokenString == "" {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
+			// Extract token from Authorization header, cookie or API key header
+			tokenString, kind := extractToken(r)
 
-			// Parse token
-			token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-					return nil, errors.New("unexpected signing method")
+			var userID int64
+			var scopes []string
+			var keyID int64
+			var expiresAt *time.Time
+			switch {
+			case kind == tokenAPIKey && jwtConfig.APIKeys != nil:
+				key, err := jwtConfig.APIKeys.Authenticate(r.Context(), tokenString)
+				if err != nil {
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
 				}
-				return []byte(jwtConfig.SecretKey), nil
-			})
-
-			if err != nil || !token.Valid {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-
-			// Extract user ID from claims
-			claims, ok := token.Claims.(*JWTClaims)
-			if !ok {
+				userID = key.UserID
+				scopes = key.Scopes
+				keyID = key.ID
+				expiresAt = key.ExpiresAt
+			case kind == tokenJWT || kind == tokenCookie:
+				claims, err := parseToken(tokenString, jwtConfig.verificationKeys())
+				if err != nil {
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				}
+				userID = claims.UserID
+				if claims.ExpiresAt != nil {
+					expiresAt = &claims.ExpiresAt.Time
+				}
+			default:
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
 			// Verify that user exists in database
 			ctx := r.Context()
-			user, err := jwtConfig.Repo.GetUserByID(ctx, claims.UserID)
-			if err != nil || user == nil {
+			user, err := jwtConfig.Repo.GetUserByID(ctx, userID)
+			if err != nil || user == nil || user.DisabledAt != nil {
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
-			// Add user ID to request context
-			ctx = context.WithValue(ctx, UserIDKey, claims.UserID)
+			// Add user ID, role and API key scopes to request context.
+			// The role is taken from the database rather than the token
+			// claims so that a demotion applies immediately.
+			ctx = context.WithValue(ctx, UserIDKey, userID)
+			logging.AddAttrs(ctx, "user_id", userID)
+			ctx = context.WithValue(ctx, RoleKey, user.Role)
+			if kind == tokenAPIKey {
+				ctx = context.WithValue(ctx, ScopesKey, scopes)
+				ctx = context.WithValue(ctx, APIKeyIDKey, keyID)
+			}
+			if expiresAt != nil {
+				ctx = context.WithValue(ctx, ExpiresAtKey, *expiresAt)
+			}
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
-// extractToken extracts JWT token from Authorization header or cookie
-func extractToken(r *http.Request) string {
+// Revalidate checks that the credentials a request was authenticated with
+// are still good: the user hasn't been disabled and the API key, if any,
+// hasn't been revoked or expired. Token expiry is left to the caller, see
+// GetExpiresAt. Long-lived connections call it before acting for the user.
+func (c *JWTConfig) Revalidate(ctx context.Context) (bool, error) {
+	userID, ok := GetUserID(ctx)
+	if !ok {
+		return false, nil
+	}
+
+	user, err := c.Repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	if user == nil || user.DisabledAt != nil {
+		return false, nil
+	}
+
+	keyID, ok := ctx.Value(APIKeyIDKey).(int64)
+	if !ok {
+		return true, nil
+	}
+	return c.APIKeys.Active(ctx, userID, keyID)
+}
+
+// RequireScope creates middleware that rejects API key requests lacking
+// the scope. Requests authenticated with a user token are always allowed.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !HasScope(r.Context(), scope) {
+				http.Error(w, "Insufficient scope", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// HasScope reports whether the request may use the scope: API keys must
+// have been granted it, user tokens have every scope
+func HasScope(ctx context.Context, scope string) bool {
+	scopes, isAPIKey := GetScopes(ctx)
+	if !isAPIKey {
+		return true
+	}
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireSession creates middleware that rejects requests authenticated
+// with an API key, e.g. for account management routes
+func RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, isAPIKey := GetScopes(r.Context()); isAPIKey {
+			http.Error(w, "API keys are not allowed here", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseToken validates the JWT against each of the keys and returns its
+// claims
+func parseToken(tokenString string, keys []string) (*JWTClaims, error) {
+	for _, key := range keys {
+		token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, errors.New("unexpected signing method")
+			}
+			return []byte(key), nil
+		})
+		if err != nil || !token.Valid {
+			continue
+		}
+
+		claims, ok := token.Claims.(*JWTClaims)
+		if !ok {
+			return nil, errors.New("invalid token claims")
+		}
+
+		return claims, nil
+	}
+
+	return nil, errors.New("invalid token")
+}
+
+// extractToken extracts credentials from the Authorization header,
+// the X-API-Key header or the auth cookie
+func extractToken(r *http.Request) (string, tokenKind) {
 	// Try from Authorization header first
 	authHeader := r.Header.Get("Authorization")
 	if authHeader != "" && strings.HasPrefix(authHeader, bearerSchema) {
-		return strings.TrimPrefix(authHeader, bearerSchema)
+		return strings.TrimPrefix(authHeader, bearerSchema), tokenJWT
+	}
+
+	// Try from API key header
+	if apiKey := r.Header.Get(apiKeyHeader); apiKey != "" {
+		return apiKey, tokenAPIKey
 	}
 
 	// Try from cookie
 	cookie, err := r.Cookie(authCookieName)
 	if err == nil {
-		return cookie.Value
+		return cookie.Value, tokenCookie
 	}
 
-	return ""
+	return "", tokenNone
 }
 
-// SetAuthCookie sets authentication cookie
-func SetAuthCookie(w http.ResponseWriter, token string) {
+// CookieConfig contains attributes of the cookies set by the server
+type CookieConfig struct {
+	Secure   bool
+	SameSite http.SameSite
+	Domain   string
+	MaxAge   time.Duration
+}
+
+// ParseSameSite converts a SameSite name from configuration
+func ParseSameSite(name string) (http.SameSite, error) {
+	switch strings.ToLower(name) {
+	case "", "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("unknown SameSite mode %q", name)
+	}
+}
+
+// SetAuthCookie sets authentication cookie together with a CSRF cookie
+// that cookie-authenticated requests have to echo back
+func SetAuthCookie(w http.ResponseWriter, token string, cfg CookieConfig) error {
 	http.SetCookie(w, &http.Cookie{
 		Name:     authCookieName,
 		Value:    token,
 		Path:     "/",
+		Domain:   cfg.Domain,
 		HttpOnly: true,
-		MaxAge:   int(jwtExpirationTime.Seconds()),
+		Secure:   cfg.Secure,
+		SameSite: cfg.SameSite,
+		MaxAge:   int(cfg.MaxAge.Seconds()),
 	})
+
+	return setCSRFCookie(w, cfg)
+}
+
+// GetScopes extracts API key scopes from request context. The second value
+// is false when the request was not authenticated with an API key.
+func GetScopes(ctx context.Context) ([]string, bool) {
+	scopes, ok := ctx.Value(ScopesKey).([]string)
+	return scopes, ok
+}
+
+// GetExpiresAt extracts the expiry of the request's credentials from
+// request context. The second value is false if they don't expire.
+func GetExpiresAt(ctx context.Context) (time.Time, bool) {
+	expiresAt, ok := ctx.Value(ExpiresAtKey).(time.Time)
+	return expiresAt, ok
+}
+
+// GetRole extracts user role from request context
+func GetRole(ctx context.Context) (string, bool) {
+	role, ok := ctx.Value(RoleKey).(string)
+	return role, ok
 }
 
 // GetUserID extracts user ID from request context
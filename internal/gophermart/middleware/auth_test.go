@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/service"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const testSecret = "test-secret"
+
+// userRepo returns the users it holds
+type userRepo struct {
+	repository.Repository
+	users map[int64]*models.User
+}
+
+func (r *userRepo) GetUserByID(ctx context.Context, id int64) (*models.User, error) {
+	return r.users[id], nil
+}
+
+func newTestJWTConfig() *JWTConfig {
+	return &JWTConfig{
+		SecretKey:    testSecret,
+		PreviousKeys: []string{"previous-secret"},
+		TokenTTL:     time.Hour,
+		Repo: &userRepo{users: map[int64]*models.User{
+			42: {ID: 42, Login: "alice", Role: models.RoleUser},
+		}},
+	}
+}
+
+// signToken signs session claims for user 42 with the key
+func signToken(t *testing.T, key string, expiresAt time.Time) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
+		UserID: 42,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}).SignedString([]byte(key))
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	return token
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	cfg := newTestJWTConfig()
+	valid, err := cfg.GenerateToken(42, models.RoleUser)
+	if err != nil {
+		t.Fatalf("GenerateToken: %v", err)
+	}
+
+	// The OIDC service is set up with the JWT secret, as in the server
+	oidc := service.NewOIDCService(cfg.Repo, service.OIDCConfig{}, testSecret)
+	challenge, err := oidc.BeginTwoFactor(42)
+	if err != nil {
+		t.Fatalf("BeginTwoFactor: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		cookie string
+		want   int
+	}{
+		{name: "bearer token", header: "Bearer " + valid, want: http.StatusOK},
+		{name: "cookie token", cookie: valid, want: http.StatusOK},
+		{name: "previous key", header: "Bearer " + signToken(t, "previous-secret", time.Now().Add(time.Hour)), want: http.StatusOK},
+		{name: "no credentials", want: http.StatusUnauthorized},
+		{name: "unknown key", header: "Bearer " + signToken(t, "other-secret", time.Now().Add(time.Hour)), want: http.StatusUnauthorized},
+		{name: "expired token", header: "Bearer " + signToken(t, testSecret, time.Now().Add(-time.Minute)), want: http.StatusUnauthorized},
+		{name: "OIDC challenge as bearer", header: "Bearer " + challenge, want: http.StatusUnauthorized},
+		{name: "OIDC challenge as cookie", cookie: challenge, want: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotUserID int64
+			h := AuthMiddleware(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotUserID, _ = GetUserID(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: authCookieName, Value: tt.cookie})
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && gotUserID != 42 {
+				t.Fatalf("got user %d, want 42", gotUserID)
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareRejectsDisabledUser(t *testing.T) {
+	cfg := newTestJWTConfig()
+	disabledAt := time.Now()
+	cfg.Repo.(*userRepo).users[42].DisabledAt = &disabledAt
+	token, err := cfg.GenerateToken(42, models.RoleUser)
+	if err != nil {
+		t.Fatalf("GenerateToken: %v", err)
+	}
+
+	h := AuthMiddleware(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
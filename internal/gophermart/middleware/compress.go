@@ -0,0 +1,302 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressibleTypes are the response content types worth compressing.
+// Event streams are left out on purpose: compression would hold back
+// events until enough of them fill a block.
+var compressibleTypes = map[string]bool{
+	"application/json": true,
+	"application/xml":  true,
+	"text/plain":       true,
+	"text/html":        true,
+	"text/csv":         true,
+}
+
+// encoder is a compressor that can be reused for another response
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var encoders = map[string]*sync.Pool{
+	"gzip": {New: func() any { return gzip.NewWriter(io.Discard) }},
+	// The deflate content coding is the zlib format
+	"deflate": {New: func() any { return zlib.NewWriter(io.Discard) }},
+}
+
+// Compress creates middleware that compresses responses with gzip or
+// deflate as negotiated by Accept-Encoding. Only responses of the
+// compressible content types that reach minSize bytes are compressed;
+// smaller ones aren't worth the overhead. WebSocket upgrades are passed
+// through.
+func Compress(minSize int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Accept-Encoding")
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+			if encoding == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// DecodedETag returns the ETag a handler set for a response that Compress
+// gave an encoding-specific ETag, or the ETag unchanged if it has no
+// encoding suffix. Handlers use it to match If-None-Match against their
+// own ETag whichever encoding the client got.
+func DecodedETag(etag string) string {
+	if !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	for encoding := range encoders {
+		if suffix := "-" + encoding + `"`; strings.HasSuffix(etag, suffix) {
+			return strings.TrimSuffix(etag, suffix) + `"`
+		}
+	}
+	return etag
+}
+
+// negotiateEncoding picks gzip or deflate from the Accept-Encoding header,
+// preferring gzip when both are equally acceptable. It returns "" if
+// neither is acceptable.
+func negotiateEncoding(header string) string {
+	quality := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(key) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				parsed = 0
+			}
+			q = parsed
+		}
+		quality[name] = q
+	}
+
+	acceptable := func(encoding string) float64 {
+		if q, ok := quality[encoding]; ok {
+			return q
+		}
+		return quality["*"]
+	}
+	gzipQ, deflateQ := acceptable("gzip"), acceptable("deflate")
+	switch {
+	case gzipQ > 0 && gzipQ >= deflateQ:
+		return "gzip"
+	case deflateQ > 0:
+		return "deflate"
+	default:
+		return ""
+	}
+}
+
+// compressWriter buffers the start of a response until it can tell whether
+// to compress it: once minSize bytes are written, or when the response is
+// flushed or finished
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	decided bool
+	buf     []byte
+	enc     encoder
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.status != 0 {
+		return
+	}
+	cw.status = code
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	if !cw.decided {
+		if !cw.compressible() {
+			cw.decide(false)
+		} else {
+			cw.buf = append(cw.buf, p...)
+			if len(cw.buf) < cw.minSize {
+				return len(p), nil
+			}
+			if err := cw.decide(true); err != nil {
+				return 0, err
+			}
+			return len(p), nil
+		}
+	}
+
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush sends what has been written so far, compressing it if it would be
+// compressed anyway
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		cw.decide(len(cw.buf) >= cw.minSize && cw.compressible())
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer for http.ResponseController
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// compressible reports whether the response may be compressed judging by
+// its status and headers
+func (cw *compressWriter) compressible() bool {
+	switch {
+	case cw.status < http.StatusOK, cw.status == http.StatusNoContent, cw.status == http.StatusNotModified:
+		return false
+	case cw.Header().Get("Content-Encoding") != "":
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(cw.Header().Get("Content-Type"))
+	return err == nil && compressibleTypes[mediaType]
+}
+
+// decide writes the header, compressed or not, followed by the buffered
+// start of the body
+func (cw *compressWriter) decide(compress bool) error {
+	cw.decided = true
+
+	if compress {
+		h := cw.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", cw.encoding)
+		// The compressed body is not byte for byte the one the strong ETag
+		// names, so it gets a strong ETag of its own for the encoding
+		if etag := h.Get("ETag"); len(etag) > 1 && strings.HasPrefix(etag, `"`) && strings.HasSuffix(etag, `"`) {
+			h.Set("ETag", etag[:len(etag)-1]+"-"+cw.encoding+`"`)
+		}
+
+		cw.enc = encoders[cw.encoding].Get().(encoder)
+		cw.enc.Reset(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	buf := cw.buf
+	cw.buf = nil
+	if cw.enc != nil {
+		_, err := cw.enc.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+// close finishes the response once the handler has returned
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if cw.status == 0 {
+			// Nothing was written; the server sends an empty 200
+			return
+		}
+		// Short responses are sent as they are
+		cw.decide(false)
+	}
+	if cw.enc != nil {
+		cw.enc.Close()
+		encoders[cw.encoding].Put(cw.enc)
+		cw.enc = nil
+	}
+}
+
+// Decompress creates middleware that decompresses request bodies sent with
+// Content-Encoding: gzip. Since a small compressed body can expand to
+// gigabytes, bodies that decompress to more than maxSize bytes are
+// rejected with 413. Other encodings get 415.
+func Decompress(maxSize int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+			case "", "identity":
+				next.ServeHTTP(w, r)
+				return
+			case "gzip", "x-gzip":
+			default:
+				w.Header().Set("Accept-Encoding", "gzip")
+				http.Error(w, "Unsupported content encoding", http.StatusUnsupportedMediaType)
+				return
+			}
+
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "Invalid gzip body", http.StatusBadRequest)
+				return
+			}
+			defer zr.Close()
+
+			// Read one byte more than allowed to tell a body of exactly
+			// maxSize bytes from a larger one
+			body, err := io.ReadAll(io.LimitReader(zr, maxSize+1))
+			if err != nil {
+				http.Error(w, "Invalid gzip body", http.StatusBadRequest)
+				return
+			}
+			if int64(len(body)) > maxSize {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = int64(len(body))
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{header: "", want: ""},
+		{header: "gzip", want: "gzip"},
+		{header: "deflate", want: "deflate"},
+		{header: "gzip, deflate, br", want: "gzip"},
+		{header: "deflate, gzip", want: "gzip"},
+		{header: "gzip;q=0.5, deflate", want: "deflate"},
+		{header: "gzip;q=0, deflate;q=0", want: ""},
+		{header: "GZIP", want: "gzip"},
+		{header: "*", want: "gzip"},
+		{header: "*;q=0.1, gzip;q=0", want: "deflate"},
+		{header: "br", want: ""},
+		{header: "gzip;q=bogus", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := negotiateEncoding(tt.header); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// decode returns the body of a response in the given encoding
+func decode(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+	var r io.Reader = bytes.NewReader(body)
+	var err error
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(r)
+	case "deflate":
+		r, err = zlib.NewReader(r)
+	}
+	if err != nil {
+		t.Fatalf("open %s body: %v", encoding, err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read %s body: %v", encoding, err)
+	}
+	return string(data)
+}
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat(`{"number":"12345678903"},`, 100)
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		status         int
+		body           string
+		etag           string
+		wantEncoding   string
+		wantETag       string
+	}{
+		{name: "gzip", acceptEncoding: "gzip", contentType: "application/json", body: large, wantEncoding: "gzip"},
+		{name: "deflate", acceptEncoding: "deflate", contentType: "application/json", body: large, wantEncoding: "deflate"},
+		{name: "not accepted", contentType: "application/json", body: large},
+		{name: "below minimum size", acceptEncoding: "gzip", contentType: "application/json", body: "{}"},
+		{name: "incompressible type", acceptEncoding: "gzip", contentType: "image/png", body: large},
+		{name: "event stream", acceptEncoding: "gzip", contentType: "text/event-stream", body: large},
+		{name: "not modified", acceptEncoding: "gzip", contentType: "application/json", status: http.StatusNotModified, etag: `"1-2"`, wantETag: `"1-2"`},
+		{name: "strong ETag names the encoding", acceptEncoding: "gzip", contentType: "application/json", body: large, etag: `"1-2"`, wantEncoding: "gzip", wantETag: `"1-2-gzip"`},
+		{name: "weak ETag is kept", acceptEncoding: "deflate", contentType: "application/json", body: large, etag: `W/"1-2"`, wantEncoding: "deflate", wantETag: `W/"1-2"`},
+		{name: "uncompressed ETag is kept", contentType: "application/json", body: large, etag: `"1-2"`, wantETag: `"1-2"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Compress(256)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				if tt.etag != "" {
+					w.Header().Set("ETag", tt.etag)
+				}
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				io.WriteString(w, tt.body)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if got := rec.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("got Content-Encoding %q, want %q", got, tt.wantEncoding)
+			}
+			if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Fatalf("got Vary %q, want Accept-Encoding", got)
+			}
+			if got := rec.Header().Get("ETag"); got != tt.wantETag {
+				t.Fatalf("got ETag %q, want %q", got, tt.wantETag)
+			}
+			if got := decode(t, tt.wantEncoding, rec.Body.Bytes()); got != tt.body {
+				t.Fatalf("got body %q, want %q", got, tt.body)
+			}
+		})
+	}
+}
+
+func TestDecodedETag(t *testing.T) {
+	tests := []struct {
+		etag string
+		want string
+	}{
+		{etag: `"1-2"`, want: `"1-2"`},
+		{etag: `"1-2-gzip"`, want: `"1-2"`},
+		{etag: `"1-2-deflate"`, want: `"1-2"`},
+		{etag: `"1-2-br"`, want: `"1-2-br"`},
+		{etag: `*`, want: `*`},
+		{etag: `1-2-gzip`, want: `1-2-gzip`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.etag, func(t *testing.T) {
+			if got := DecodedETag(tt.etag); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// gzipped compresses data for request bodies
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.WriteString(zw, data); err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     int
+		wantBody string
+	}{
+		{name: "plain body", body: []byte("12345678903"), want: http.StatusOK, wantBody: "12345678903"},
+		{name: "identity", encoding: "identity", body: []byte("12345678903"), want: http.StatusOK, wantBody: "12345678903"},
+		{name: "gzip", encoding: "gzip", body: gzipped(t, "12345678903"), want: http.StatusOK, wantBody: "12345678903"},
+		{name: "x-gzip", encoding: "x-gzip", body: gzipped(t, "12345678903"), want: http.StatusOK, wantBody: "12345678903"},
+		{name: "exactly the limit", encoding: "gzip", body: gzipped(t, strings.Repeat("a", 64)), want: http.StatusOK, wantBody: strings.Repeat("a", 64)},
+		{name: "over the limit", encoding: "gzip", body: gzipped(t, strings.Repeat("a", 65)), want: http.StatusRequestEntityTooLarge},
+		{name: "not gzip", encoding: "gzip", body: []byte("12345678903"), want: http.StatusBadRequest},
+		{name: "truncated", encoding: "gzip", body: gzipped(t, strings.Repeat("a", 64))[:20], want: http.StatusBadRequest},
+		{name: "unsupported encoding", encoding: "br", body: []byte("12345678903"), want: http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotBody string
+			h := Decompress(64)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Content-Encoding") != "" && r.Header.Get("Content-Encoding") != "identity" {
+					t.Errorf("Content-Encoding %q passed on", r.Header.Get("Content-Encoding"))
+				}
+				data, _ := io.ReadAll(r.Body)
+				gotBody = string(data)
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/api/user/orders", bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && gotBody != tt.wantBody {
+				t.Fatalf("got body %q, want %q", gotBody, tt.wantBody)
+			}
+			if tt.want == http.StatusUnsupportedMediaType && rec.Header().Get("Accept-Encoding") != "gzip" {
+				t.Fatalf("got Accept-Encoding %q, want gzip", rec.Header().Get("Accept-Encoding"))
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		authToken bool
+		bearer    bool
+		apiKey    bool
+		cookie    string
+		header    string
+		want      int
+	}{
+		{name: "safe method", method: http.MethodGet, authToken: true, want: http.StatusOK},
+		{name: "matching token", method: http.MethodPost, authToken: true, cookie: "abc", header: "abc", want: http.StatusOK},
+		{name: "missing header", method: http.MethodPost, authToken: true, cookie: "abc", want: http.StatusForbidden},
+		{name: "missing cookie", method: http.MethodPost, authToken: true, header: "abc", want: http.StatusForbidden},
+		{name: "mismatched token", method: http.MethodDelete, authToken: true, cookie: "abc", header: "abd", want: http.StatusForbidden},
+		{name: "no token at all", method: http.MethodPut, authToken: true, want: http.StatusForbidden},
+		{name: "bearer token is exempt", method: http.MethodPost, authToken: true, bearer: true, want: http.StatusOK},
+		{name: "API key is exempt", method: http.MethodPost, apiKey: true, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			req := httptest.NewRequest(tt.method, "/api/user/orders", nil)
+			if tt.authToken {
+				req.AddCookie(&http.Cookie{Name: authCookieName, Value: "token"})
+			}
+			if tt.bearer {
+				req.Header.Set("Authorization", "Bearer token")
+			}
+			if tt.apiKey {
+				req.Header.Set(apiKeyHeader, "key")
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: tt.cookie})
+			}
+			if tt.header != "" {
+				req.Header.Set(csrfHeaderName, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetAuthCookieIssuesCSRFToken(t *testing.T) {
+	rec := httptest.NewRecorder()
+	if err := SetAuthCookie(rec, "token", CookieConfig{}); err != nil {
+		t.Fatalf("SetAuthCookie: %v", err)
+	}
+
+	var csrf *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == csrfCookieName {
+			csrf = c
+		}
+	}
+	if csrf == nil || csrf.Value == "" {
+		t.Fatal("no CSRF cookie set")
+	}
+	if csrf.HttpOnly {
+		t.Fatal("CSRF cookie must be readable by scripts")
+	}
+	if got := rec.Header().Get(csrfHeaderName); got != csrf.Value {
+		t.Fatalf("got header token %q, want the cookie value %q", got, csrf.Value)
+	}
+}
@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/service"
+	chiMiddleware "github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	idempotencyStoreTimeout  = 5 * time.Second
+	// maxIdempotentBodySize limits the bodies read into memory to be hashed
+	maxIdempotentBodySize = 1 << 20
+)
+
+// Idempotency creates middleware that makes requests carrying an
+// Idempotency-Key header safe to retry. The first response to a key is
+// stored and replayed for later requests with the same key; reusing the key
+// for a different request is rejected with 422. Server errors are not
+// stored, so such requests can be retried; neither are requests whose
+// handler panicked. Requests without the header are passed through. Must be used after AuthMiddleware, since keys are scoped
+// to the user.
+func Idempotency(idempotency *service.IdempotencyService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(idempotencyKeyHeader)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				http.Error(w, "Invalid Idempotency-Key", http.StatusBadRequest)
+				return
+			}
+
+			userID, ok := GetUserID(r.Context())
+			if !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			// The handler still needs the body after it is hashed
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Bad request", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			ctx := r.Context()
+			stored, err := idempotency.Begin(ctx, userID, key, requestHash(r, body))
+			switch {
+			case errors.Is(err, service.ErrIdempotencyKeyReused):
+				http.Error(w, "Idempotency-Key was used for a different request", http.StatusUnprocessableEntity)
+				return
+			case errors.Is(err, service.ErrIdempotencyKeyInProgress):
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "Request with this Idempotency-Key is in progress", http.StatusConflict)
+				return
+			case err != nil:
+				logging.FromContext(ctx).Error("Error checking idempotency key", "error", err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			case stored != nil:
+				if stored.ContentType != "" {
+					w.Header().Set("Content-Type", stored.ContentType)
+				}
+				w.Header().Set(idempotentReplayedHeader, "true")
+				w.WriteHeader(stored.StatusCode)
+				w.Write(stored.Body)
+				return
+			}
+
+			// Free the key if the handler panics, before the panic reaches
+			// the recoverer, so that the request can be retried
+			finished := false
+			defer func() {
+				if finished {
+					return
+				}
+				releaseCtx, cancel := context.WithTimeout(context.Background(), idempotencyStoreTimeout)
+				defer cancel()
+				if err := idempotency.Release(releaseCtx, userID, key); err != nil {
+					logging.FromContext(ctx).Error("Error releasing idempotency key", "error", err)
+				}
+			}()
+
+			var buf bytes.Buffer
+			ww := chiMiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			ww.Tee(&buf)
+			next.ServeHTTP(ww, r)
+			finished = true
+
+			// The action has run by now, so its outcome is recorded even if
+			// the client has gone away
+			storeCtx, cancel := context.WithTimeout(context.Background(), idempotencyStoreTimeout)
+			defer cancel()
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+				if ctx.Err() != nil {
+					// Nothing was written before the deadline; the timeout
+					// middleware answers 504
+					status = http.StatusGatewayTimeout
+				}
+			}
+			if status >= http.StatusInternalServerError {
+				if err := idempotency.Release(storeCtx, userID, key); err != nil {
+					logging.FromContext(ctx).Error("Error releasing idempotency key", "error", err)
+				}
+				return
+			}
+
+			err = idempotency.Complete(storeCtx, &models.IdempotencyKey{
+				UserID:      userID,
+				Key:         key,
+				StatusCode:  status,
+				ContentType: ww.Header().Get("Content-Type"),
+				Body:        buf.Bytes(),
+			})
+			if err != nil {
+				logging.FromContext(ctx).Error("Error storing idempotent response", "error", err)
+			}
+		})
+	}
+}
+
+// requestHash identifies the request a key was first used with
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,238 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/service"
+)
+
+// idempotencyRepo keeps idempotency keys in memory
+type idempotencyRepo struct {
+	repository.Repository
+	mu   sync.Mutex
+	keys map[string]models.IdempotencyKey
+}
+
+func newIdempotencyRepo() *idempotencyRepo {
+	return &idempotencyRepo{keys: make(map[string]models.IdempotencyKey)}
+}
+
+func idempotencyRepoKey(userID int64, key string) string {
+	return fmt.Sprintf("%d/%s", userID, key)
+}
+
+func (r *idempotencyRepo) CreateIdempotencyKey(ctx context.Context, key *models.IdempotencyKey) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := idempotencyRepoKey(key.UserID, key.Key)
+	if _, ok := r.keys[k]; ok {
+		return false, nil
+	}
+	r.keys[k] = *key
+	return true, nil
+}
+
+func (r *idempotencyRepo) GetIdempotencyKey(ctx context.Context, userID int64, key string) (*models.IdempotencyKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.keys[idempotencyRepoKey(userID, key)]
+	if !ok {
+		return nil, nil
+	}
+	return &stored, nil
+}
+
+func (r *idempotencyRepo) CompleteIdempotencyKey(ctx context.Context, key *models.IdempotencyKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := idempotencyRepoKey(key.UserID, key.Key)
+	stored := r.keys[k]
+	stored.StatusCode = key.StatusCode
+	stored.ContentType = key.ContentType
+	stored.Body = key.Body
+	r.keys[k] = stored
+	return nil
+}
+
+func (r *idempotencyRepo) DeleteIdempotencyKey(ctx context.Context, userID int64, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.keys, idempotencyRepoKey(userID, key))
+	return nil
+}
+
+func TestIdempotency(t *testing.T) {
+	type request struct {
+		path         string
+		body         string
+		wantStatus   int
+		wantReplayed bool
+	}
+
+	tests := []struct {
+		name      string
+		key       string
+		status    int
+		requests  []request
+		wantCalls int
+	}{
+		{
+			name: "without key every request runs", status: http.StatusOK,
+			requests: []request{
+				{path: "/withdraw", body: "a", wantStatus: http.StatusOK},
+				{path: "/withdraw", body: "a", wantStatus: http.StatusOK},
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "retry is replayed", key: "k1", status: http.StatusOK,
+			requests: []request{
+				{path: "/withdraw", body: "a", wantStatus: http.StatusOK},
+				{path: "/withdraw", body: "a", wantStatus: http.StatusOK, wantReplayed: true},
+				{path: "/withdraw", body: "a", wantStatus: http.StatusOK, wantReplayed: true},
+			},
+			wantCalls: 1,
+		},
+		{
+			name: "client errors are replayed", key: "k1", status: http.StatusPaymentRequired,
+			requests: []request{
+				{path: "/withdraw", body: "a", wantStatus: http.StatusPaymentRequired},
+				{path: "/withdraw", body: "a", wantStatus: http.StatusPaymentRequired, wantReplayed: true},
+			},
+			wantCalls: 1,
+		},
+		{
+			name: "different body", key: "k1", status: http.StatusOK,
+			requests: []request{
+				{path: "/withdraw", body: "a", wantStatus: http.StatusOK},
+				{path: "/withdraw", body: "b", wantStatus: http.StatusUnprocessableEntity},
+			},
+			wantCalls: 1,
+		},
+		{
+			name: "different route", key: "k1", status: http.StatusOK,
+			requests: []request{
+				{path: "/withdraw", body: "a", wantStatus: http.StatusOK},
+				{path: "/orders", body: "a", wantStatus: http.StatusUnprocessableEntity},
+			},
+			wantCalls: 1,
+		},
+		{
+			name: "server errors are not stored", key: "k1", status: http.StatusInternalServerError,
+			requests: []request{
+				{path: "/withdraw", body: "a", wantStatus: http.StatusInternalServerError},
+				{path: "/withdraw", body: "a", wantStatus: http.StatusInternalServerError},
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "key too long", key: strings.Repeat("k", maxIdempotencyKeyLength+1), status: http.StatusOK,
+			requests: []request{
+				{path: "/withdraw", body: "a", wantStatus: http.StatusBadRequest},
+			},
+			wantCalls: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := service.NewIdempotencyService(newIdempotencyRepo(), time.Hour)
+			calls := 0
+			h := Idempotency(svc)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				fmt.Fprintf(w, `{"call":%d}`, calls)
+			}))
+
+			var first string
+			for i, req := range tt.requests {
+				r := httptest.NewRequest(http.MethodPost, req.path, strings.NewReader(req.body))
+				r = r.WithContext(context.WithValue(r.Context(), UserIDKey, int64(42)))
+				if tt.key != "" {
+					r.Header.Set(idempotencyKeyHeader, tt.key)
+				}
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, r)
+
+				if rec.Code != req.wantStatus {
+					t.Fatalf("request %d: got status %d, want %d", i, rec.Code, req.wantStatus)
+				}
+				replayed := rec.Header().Get(idempotentReplayedHeader) == "true"
+				if replayed != req.wantReplayed {
+					t.Fatalf("request %d: got replayed %v, want %v", i, replayed, req.wantReplayed)
+				}
+				if i == 0 {
+					first = rec.Body.String()
+				} else if replayed {
+					if rec.Body.String() != first {
+						t.Fatalf("request %d: replayed body %q, want %q", i, rec.Body.String(), first)
+					}
+					if got := rec.Header().Get("Content-Type"); got != "application/json" {
+						t.Fatalf("request %d: replayed Content-Type %q", i, got)
+					}
+				}
+			}
+
+			if calls != tt.wantCalls {
+				t.Fatalf("handler ran %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestIdempotencyKeyInProgress(t *testing.T) {
+	repo := newIdempotencyRepo()
+	svc := service.NewIdempotencyService(repo, time.Hour)
+
+	// The first request is still running when the retry arrives
+	var retry *httptest.ResponseRecorder
+	var h http.Handler
+	h = Idempotency(svc)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if retry == nil {
+			retry = httptest.NewRecorder()
+			h.ServeHTTP(retry, newIdempotentRequest("k1"))
+		}
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), newIdempotentRequest("k1"))
+
+	if retry.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want %d", retry.Code, http.StatusConflict)
+	}
+	if retry.Header().Get("Retry-After") == "" {
+		t.Fatal("no Retry-After on conflict")
+	}
+}
+
+func TestIdempotencyReleasesKeyOnPanic(t *testing.T) {
+	repo := newIdempotencyRepo()
+	svc := service.NewIdempotencyService(repo, time.Hour)
+	h := Idempotency(svc)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler failed")
+	}))
+
+	func() {
+		defer func() { recover() }()
+		h.ServeHTTP(httptest.NewRecorder(), newIdempotentRequest("k1"))
+	}()
+
+	if stored, _ := repo.GetIdempotencyKey(context.Background(), 42, "k1"); stored != nil {
+		t.Fatal("key was not released after the panic")
+	}
+}
+
+// newIdempotentRequest returns a request of user 42 with the key
+func newIdempotentRequest(key string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/withdraw", strings.NewReader("a"))
+	r.Header.Set(idempotencyKeyHeader, key)
+	return r.WithContext(context.WithValue(r.Context(), UserIDKey, int64(42)))
+}
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/service"
+)
+
+// Rate limited route groups
+const (
+	RateLimitGroupAuth   = "auth"
+	RateLimitGroupAPI    = "api"
+	RateLimitGroupOrders = "orders"
+)
+
+// RateLimitByIP creates middleware that limits requests of the route group
+// per client IP, for routes that are not authenticated
+func RateLimitByIP(limiter *service.RateLimiter, group string) func(http.Handler) http.Handler {
+	return rateLimit(limiter, group, func(r *http.Request) (string, bool) {
+		return "ip:" + ClientIP(r), true
+	})
+}
+
+// RateLimitByUser creates middleware that limits requests of the route
+// group per user. Must be used after AuthMiddleware.
+func RateLimitByUser(limiter *service.RateLimiter, group string) func(http.Handler) http.Handler {
+	return rateLimit(limiter, group, func(r *http.Request) (string, bool) {
+		userID, ok := GetUserID(r.Context())
+		return UserRateLimitKey(userID), ok
+	})
+}
+
+// UserRateLimitKey returns the rate limit key of the user, for limiting
+// actions that don't go through RateLimitByUser
+func UserRateLimitKey(userID int64) string {
+	return "user:" + strconv.FormatInt(userID, 10)
+}
+
+// rateLimit takes a token for the request key and rejects the request with
+// 429 if there is none. The RateLimit-* headers describe the limit and the
+// remaining quota. If the limiter fails, the request is let through.
+func rateLimit(limiter *service.RateLimiter, group string, key func(r *http.Request) (string, bool)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k, ok := key(r)
+			if !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			decision, err := limiter.Allow(r.Context(), group, k)
+			if err != nil {
+				logging.FromContext(r.Context()).Error("Error checking rate limit", "group", group, "error", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if decision == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", decision.Limit.Limit, ceilSeconds(decision.Limit.Period)))
+			h.Set("RateLimit-Limit", strconv.Itoa(decision.Limit.Limit))
+			h.Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+			h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+
+			if !decision.Allowed {
+				h.Set("Retry-After", strconv.Itoa(ceilSeconds(decision.RetryAfter)))
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ceilSeconds rounds the duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RealIP creates middleware that replaces the request's remote address with
+// the client address forwarded by a trusted reverse proxy. The proxy
+// headers are only honoured when the peer itself is one of the trusted
+// networks. X-Forwarded-For is read from the right, skipping trusted
+// proxies, since the entries on the left are whatever the client sent;
+// X-Real-IP is used when there is no X-Forwarded-For.
+func RealIP(trusted []*net.IPNet) func(http.Handler) http.Handler {
+	isTrusted := func(ip net.IP) bool {
+		for _, n := range trusted {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			peer := net.ParseIP(ClientIP(r))
+			if peer == nil || !isTrusted(peer) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+				if ip := forwardedClient(forwarded, isTrusted); ip != nil {
+					r.RemoteAddr = ip.String()
+				}
+			} else if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+				r.RemoteAddr = ip.String()
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedClient returns the rightmost X-Forwarded-For address that isn't
+// a trusted proxy. The walk stops at a malformed entry, leaving the nearest
+// trusted proxy as the client. It returns nil if no entry could be read.
+func forwardedClient(headers []string, isTrusted func(net.IP) bool) net.IP {
+	var hops []string
+	for _, header := range headers {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	var nearest net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		if !isTrusted(ip) {
+			return ip
+		}
+		nearest = ip
+	}
+	return nearest
+}
@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// mustParseCIDRs parses networks for tests
+func mustParseCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("parse %s: %v", cidr, err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+func TestRealIP(t *testing.T) {
+	trusted := mustParseCIDRs(t, "10.0.0.0/8", "192.168.1.1/32")
+
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded []string
+		realIP    string
+		want      string
+	}{
+		{
+			name: "untrusted peer",
+			peer: "203.0.113.7:1234", forwarded: []string{"198.51.100.1"},
+			want: "203.0.113.7",
+		},
+		{
+			name: "trusted peer without headers",
+			peer: "10.0.0.1:1234",
+			want: "10.0.0.1",
+		},
+		{
+			name: "trusted peer forwards client",
+			peer: "10.0.0.1:1234", forwarded: []string{"198.51.100.1"},
+			want: "198.51.100.1",
+		},
+		{
+			name: "spoofed entries on the left are ignored",
+			peer: "10.0.0.1:1234", forwarded: []string{"1.2.3.4, 198.51.100.1"},
+			want: "198.51.100.1",
+		},
+		{
+			name: "trusted proxies on the right are skipped",
+			peer: "10.0.0.1:1234", forwarded: []string{"198.51.100.1, 192.168.1.1, 10.0.0.2"},
+			want: "198.51.100.1",
+		},
+		{
+			name: "entries across several headers",
+			peer: "10.0.0.1:1234", forwarded: []string{"198.51.100.1", "10.0.0.2"},
+			want: "198.51.100.1",
+		},
+		{
+			name: "malformed entry stops the walk",
+			peer: "10.0.0.1:1234", forwarded: []string{"198.51.100.1, bogus, 10.0.0.2"},
+			want: "10.0.0.2",
+		},
+		{
+			name: "only trusted proxies",
+			peer: "10.0.0.1:1234", forwarded: []string{"10.0.0.3, 10.0.0.2"},
+			want: "10.0.0.3",
+		},
+		{
+			name: "unreadable header keeps the peer",
+			peer: "10.0.0.1:1234", forwarded: []string{"bogus"},
+			want: "10.0.0.1",
+		},
+		{
+			name: "X-Real-IP from trusted peer",
+			peer: "10.0.0.1:1234", realIP: "198.51.100.1",
+			want: "198.51.100.1",
+		},
+		{
+			name: "X-Forwarded-For wins over X-Real-IP",
+			peer: "10.0.0.1:1234", forwarded: []string{"198.51.100.1"}, realIP: "198.51.100.2",
+			want: "198.51.100.1",
+		},
+		{
+			name: "X-Real-IP from untrusted peer",
+			peer: "203.0.113.7:1234", realIP: "198.51.100.1",
+			want: "203.0.113.7",
+		},
+		{
+			name: "IPv6 client",
+			peer: "10.0.0.1:1234", forwarded: []string{"2001:db8::1"},
+			want: "2001:db8::1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := RealIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = ClientIP(r)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.peer
+			for _, v := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != tt.want {
+				t.Fatalf("got client %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
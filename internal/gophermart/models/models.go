@@ -1,15 +1,32 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 )
 
 // User represents a registered user
 type User struct {
-	ID           int64     `json:"id"`
-	Login        string    `json:"login"`
-	PasswordHash string    `json:"-"`
-	CreatedAt    time.Time `json:"created_at"`
+	ID           int64      `json:"id"`
+	Login        string     `json:"login"`
+	PasswordHash string     `json:"-"`
+	TOTPSecret   string     `json:"-"`
+	TOTPEnabled  bool       `json:"totp_enabled"`
+	Role         string     `json:"role"`
+	DisabledAt   *time.Time `json:"disabled_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// User roles
+const (
+	RoleUser    = "user"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+)
+
+// IsValidRole reports whether the role is known
+func IsValidRole(role string) bool {
+	return role == RoleUser || role == RoleSupport || role == RoleAdmin
 }
 
 // Order represents an order in the system
@@ -20,6 +37,16 @@ type Order struct {
 	Status     string    `json:"status"`
 	Accrual    float64   `json:"accrual,omitempty"`
 	UploadedAt time.Time `json:"uploaded_at"`
+	// TraceParent is the W3C trace context of the upload request
+	TraceParent string `json:"-"`
+}
+
+// OrderStats summarizes orders across all users
+type OrderStats struct {
+	CountByStatus map[string]int64
+	// OldestPending is the upload time of the oldest order still waiting
+	// for a final accrual status, nil if there is none
+	OldestPending *time.Time
 }
 
 // Balance represents a user's loyalty balance
@@ -37,6 +64,97 @@ type Withdrawal struct {
 	ProcessedAt time.Time `json:"processed_at"`
 }
 
+// APIKey represents a scoped API key issued to a machine client
+type APIKey struct {
+	ID        int64      `json:"id"`
+	UserID    int64      `json:"-"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	KeyHash   string     `json:"-"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// API key scopes
+const (
+	ScopeOrdersRead      = "orders:read"
+	ScopeOrdersWrite     = "orders:write"
+	ScopeBalanceRead     = "balance:read"
+	ScopeBalanceWithdraw = "balance:withdraw"
+)
+
+// AllScopes lists every scope an API key may be granted
+var AllScopes = []string{ScopeOrdersRead, ScopeOrdersWrite, ScopeBalanceRead, ScopeBalanceWithdraw}
+
+// AuditEvent represents a security-relevant action recorded in the audit log
+type AuditEvent struct {
+	ID        int64             `json:"-"`
+	UserID    int64             `json:"-"`
+	Type      string            `json:"type"`
+	IP        string            `json:"ip"`
+	UserAgent string            `json:"user_agent"`
+	RequestID string            `json:"request_id,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// Audit event types
+const (
+	EventRegister          = "register"
+	EventLoginSuccess      = "login_success"
+	EventLoginFailure      = "login_failure"
+	EventTokenRefresh      = "token_refresh"
+	EventWithdrawal        = "withdrawal"
+	EventOrderUpload       = "order_upload"
+	EventTwoFactorEnabled  = "2fa_enabled"
+	EventTwoFactorDisabled = "2fa_disabled"
+	EventAPIKeyCreated     = "api_key_created"
+	EventAPIKeyRevoked     = "api_key_revoked"
+	EventAdminAction       = "admin_action"
+)
+
+// IdempotencyKey records a request made with an Idempotency-Key header and
+// the response it got. StatusCode is 0 while the request is in progress.
+type IdempotencyKey struct {
+	UserID      int64
+	Key         string
+	RequestHash string
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// UserEvent is a change to a user's data streamed to their clients. Data
+// is the JSON payload of the event type.
+type UserEvent struct {
+	ID        int64
+	UserID    int64
+	Type      string
+	Data      json.RawMessage
+	CreatedAt time.Time
+}
+
+// User event types
+const (
+	// UserEventOrderStatus carries an OrderStatusEvent
+	UserEventOrderStatus = "order_status"
+	// UserEventBalanceChanged carries a Balance
+	UserEventBalanceChanged = "balance_changed"
+)
+
+// OrderStatusEvent is the payload of an order status event, in the same
+// shape as the orders list
+type OrderStatusEvent struct {
+	Number     string    `json:"number"`
+	Status     string    `json:"status"`
+	Accrual    float64   `json:"accrual,omitempty"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
 // AccrualResponse represents the response from the accrual system
 type AccrualResponse struct {
 	Order   string  `json:"order"`
@@ -56,3 +174,47 @@ const (
 const (
 	StatusRegistered = "REGISTERED"
 )
+
+// LoginAttempt tracks failed login attempts for a login or an IP address
+type LoginAttempt struct {
+	Scope         string
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+// LoginAttempt scopes
+const (
+	AttemptScopeLogin = "login"
+	AttemptScopeIP    = "ip"
+	// AttemptScopeTOTP counts failed TOTP checks of signed-in users, keyed
+	// by user ID
+	AttemptScopeTOTP = "totp"
+)
+
+// TokenBucket is the state of a rate limit bucket. A full bucket holds
+// capacity tokens; it is refilled at rate tokens per second and every
+// request takes one.
+type TokenBucket struct {
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+// Take refills the bucket up to now and takes a token if there is one. It
+// reports whether the token was taken.
+func (b *TokenBucket) Take(capacity, rate float64, now time.Time) bool {
+	if elapsed := now.Sub(b.UpdatedAt).Seconds(); elapsed > 0 {
+		b.Tokens += elapsed * rate
+	}
+	if b.Tokens > capacity {
+		b.Tokens = capacity
+	}
+	b.UpdatedAt = now
+
+	if b.Tokens < 1 {
+		return false
+	}
+	b.Tokens--
+	return true
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		tokens     float64
+		elapsed    time.Duration
+		capacity   float64
+		rate       float64
+		want       bool
+		wantTokens float64
+	}{
+		{name: "full bucket", tokens: 10, capacity: 10, rate: 1, want: true, wantTokens: 9},
+		{name: "last token", tokens: 1, capacity: 10, rate: 1, want: true, wantTokens: 0},
+		{name: "empty bucket", tokens: 0, capacity: 10, rate: 1, want: false, wantTokens: 0},
+		{name: "less than a token", tokens: 0.5, capacity: 10, rate: 1, want: false, wantTokens: 0.5},
+		{name: "refilled since", tokens: 0, elapsed: 2 * time.Second, capacity: 10, rate: 1, want: true, wantTokens: 1},
+		{name: "partly refilled", tokens: 0, elapsed: 500 * time.Millisecond, capacity: 10, rate: 1, want: false, wantTokens: 0.5},
+		{name: "refill stops at capacity", tokens: 5, elapsed: time.Hour, capacity: 10, rate: 1, want: true, wantTokens: 9},
+		{name: "lowered capacity", tokens: 10, capacity: 3, rate: 1, want: true, wantTokens: 2},
+		{name: "clock going back", tokens: 0, elapsed: -time.Minute, capacity: 10, rate: 1, want: false, wantTokens: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := TokenBucket{Tokens: tt.tokens, UpdatedAt: start}
+			now := start.Add(tt.elapsed)
+
+			if got := b.Take(tt.capacity, tt.rate, now); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			if b.Tokens != tt.wantTokens {
+				t.Fatalf("got %v tokens, want %v", b.Tokens, tt.wantTokens)
+			}
+			if !b.UpdatedAt.Equal(now) {
+				t.Fatalf("got UpdatedAt %v, want %v", b.UpdatedAt, now)
+			}
+		})
+	}
+}
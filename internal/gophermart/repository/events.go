@@ -0,0 +1,154 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+// userEventsChannel is the LISTEN/NOTIFY channel announcing new user
+// events. The payload is the user ID.
+const userEventsChannel = "user_events"
+
+// addUserEvent appends an event for the user and notifies listeners when
+// the transaction commits. Events of a user are serialized on the user row,
+// so their IDs commit in order and a client resuming after an ID can't
+// miss one.
+func addUserEvent(ctx context.Context, tx *sql.Tx, userID int64, eventType string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "SELECT id FROM users WHERE id = $1 FOR UPDATE", userID); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO user_events (user_id, type, data) VALUES ($1, $2, $3)",
+		userID, eventType, payload,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "SELECT pg_notify($1, $2)", userEventsChannel, strconv.FormatInt(userID, 10))
+	return err
+}
+
+// addOrderEvents records an order status change and, if the order brought
+// points, the new balance
+func addOrderEvents(ctx context.Context, tx *sql.Tx, order *models.Order) error {
+	event := models.OrderStatusEvent{
+		Number:     order.Number,
+		Status:     order.Status,
+		UploadedAt: order.UploadedAt,
+	}
+	if order.Status == models.StatusProcessed {
+		event.Accrual = order.Accrual
+	}
+	if err := addUserEvent(ctx, tx, order.UserID, models.UserEventOrderStatus, event); err != nil {
+		return err
+	}
+
+	if order.Status != models.StatusProcessed || order.Accrual == 0 {
+		return nil
+	}
+	balance, err := userBalance(ctx, tx, order.UserID)
+	if err != nil {
+		return err
+	}
+	return addUserEvent(ctx, tx, order.UserID, models.UserEventBalanceChanged, balance)
+}
+
+// GetUserEvents returns up to limit events of the user with IDs greater
+// than afterID, oldest first
+func (r *PostgresRepository) GetUserEvents(ctx context.Context, userID, afterID int64, limit int) ([]models.UserEvent, error) {
+	rows, err := r.db.QueryContext(
+		ctx,
+		`SELECT id, user_id, type, data, created_at
+         FROM user_events
+         WHERE user_id = $1 AND id > $2
+         ORDER BY id
+         LIMIT $3`,
+		userID, afterID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []models.UserEvent
+	for rows.Next() {
+		var e models.UserEvent
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Type, &e.Data, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// GetLatestUserEventID returns the ID of the user's latest event, or 0 if
+// there is none
+func (r *PostgresRepository) GetLatestUserEventID(ctx context.Context, userID int64) (int64, error) {
+	var id int64
+	err := r.db.QueryRowContext(
+		ctx,
+		"SELECT COALESCE(MAX(id), 0) FROM user_events WHERE user_id = $1",
+		userID,
+	).Scan(&id)
+	return id, err
+}
+
+func (r *PostgresRepository) DeleteUserEventsBefore(ctx context.Context, before time.Time) (int64, error) {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM user_events WHERE created_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ListenUserEvents listens for new user events on a dedicated connection
+// and calls notify with the user ID of each. It blocks until ctx is
+// cancelled or the connection fails.
+func (r *PostgresRepository) ListenUserEvents(ctx context.Context, notify func(userID int64)) error {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var listenErr error
+	conn.Raw(func(driverConn any) error {
+		pgxConn := driverConn.(*stdlib.Conn).Conn()
+
+		if _, listenErr = pgxConn.Exec(ctx, "LISTEN "+userEventsChannel); listenErr != nil {
+			return driver.ErrBadConn
+		}
+		for {
+			n, err := pgxConn.WaitForNotification(ctx)
+			if err != nil {
+				listenErr = err
+				// Don't return a listening session to the pool
+				return driver.ErrBadConn
+			}
+			if userID, err := strconv.ParseInt(n.Payload, 10, 64); err == nil {
+				notify(userID)
+			}
+		}
+	})
+	return listenErr
+}
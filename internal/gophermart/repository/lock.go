@@ -0,0 +1,125 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+)
+
+// AdvisoryLock is a Postgres session-level advisory lock. The lock belongs
+// to the database session, so it is taken on a dedicated connection that is
+// kept out of the pool while the lock is held; if that connection dies,
+// Postgres releases the lock.
+type AdvisoryLock interface {
+	// TryLock takes the lock without waiting and reports whether it did
+	TryLock(ctx context.Context) (bool, error)
+	// Held checks on the lock connection that the lock is still held
+	Held(ctx context.Context) (bool, error)
+	// Unlock releases the lock and closes its connection
+	Unlock(ctx context.Context) error
+}
+
+// postgresAdvisoryLock implements AdvisoryLock with pg_try_advisory_lock
+type postgresAdvisoryLock struct {
+	// repo is kept rather than its db, since locks may be created before
+	// the database is opened
+	repo *PostgresRepository
+	key  int64
+
+	mu   sync.Mutex
+	conn *sql.Conn
+}
+
+// NewAdvisoryLock returns the advisory lock identified by key. Nothing is
+// locked until TryLock.
+func (r *PostgresRepository) NewAdvisoryLock(key int64) AdvisoryLock {
+	return &postgresAdvisoryLock{repo: r, key: key}
+}
+
+func (l *postgresAdvisoryLock) TryLock(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	db := l.repo.db
+	if db == nil {
+		return false, errors.New("database is not initialized")
+	}
+
+	if l.conn == nil {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return false, err
+		}
+		l.conn = conn
+	}
+
+	var locked bool
+	if err := l.conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", l.key).Scan(&locked); err != nil {
+		l.closeConn(true)
+		return false, err
+	}
+	if !locked {
+		// Don't hold a connection out of the pool while waiting
+		l.closeConn(false)
+	}
+	return locked, nil
+}
+
+func (l *postgresAdvisoryLock) Held(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn == nil {
+		return false, nil
+	}
+
+	// A bigint advisory lock key is split into classid (high half) and
+	// objid (low half) in pg_locks
+	var held bool
+	err := l.conn.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM pg_locks
+			WHERE locktype = 'advisory' AND granted AND pid = pg_backend_pid()
+			  AND objsubid = 1
+			  AND classid = (($1::bigint >> 32) & 4294967295)::oid
+			  AND objid = ($1::bigint & 4294967295)::oid
+		)`, l.key).Scan(&held)
+	if err != nil {
+		// The session may be gone and the lock with it
+		l.closeConn(true)
+		return false, err
+	}
+	return held, nil
+}
+
+func (l *postgresAdvisoryLock) Unlock(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn == nil {
+		return nil
+	}
+
+	_, err := l.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", l.key)
+	// Closing the session releases the lock even if unlocking failed
+	l.closeConn(true)
+	return err
+}
+
+// closeConn returns the connection to the pool or, with discard, closes
+// the session so that a lock that failed to unlock can't stay attached to
+// a pooled connection. The caller holds mu.
+func (l *postgresAdvisoryLock) closeConn(discard bool) {
+	if l.conn == nil {
+		return
+	}
+	if discard {
+		l.conn.Raw(func(any) error {
+			return driver.ErrBadConn
+		})
+	}
+	l.conn.Close()
+	l.conn = nil
+}
@@ -3,10 +3,15 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/tracing"
+	"github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4/stdlib"
 )
 
@@ -16,23 +21,94 @@ type Repository interface {
 	CreateUser(ctx context.Context, login, passwordHash string) (int64, error)
 	GetUserByLogin(ctx context.Context, login string) (*models.User, error)
 	GetUserByID(ctx context.Context, id int64) (*models.User, error)
+	UpdateUserPasswordHash(ctx context.Context, userID int64, passwordHash string) error
+	GetUserByExternalIdentity(ctx context.Context, issuer, subject string) (*models.User, error)
+	CreateExternalUser(ctx context.Context, login, issuer, subject string) (int64, error)
+	SearchUsers(ctx context.Context, loginQuery string, limit int) ([]models.User, error)
+	SetUserRole(ctx context.Context, userID int64, role string) error
+	SetUserDisabled(ctx context.Context, userID int64, disabled bool) error
+
+	// Two-factor authentication operations
+	SetUserTOTPSecret(ctx context.Context, userID int64, secret string) error
+	EnableUserTOTP(ctx context.Context, userID int64, recoveryCodeHashes []string) error
+	DisableUserTOTP(ctx context.Context, userID int64) error
+	UseTOTPStep(ctx context.Context, userID int64, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, userID int64, codeHash string) (bool, error)
 
 	// Order operations
 	CreateOrder(ctx context.Context, userID int64, orderNumber string) error
 	GetOrderByNumber(ctx context.Context, orderNumber string) (*models.Order, error)
 	GetUserOrders(ctx context.Context, userID int64) ([]models.Order, error)
 	UpdateOrderStatus(ctx context.Context, orderNumber, status string, accrual float64) error
+	ClaimPendingOrders(ctx context.Context, limit int, lease time.Duration) ([]models.Order, error)
+	ReleaseOrderClaims(ctx context.Context, orderNumbers []string) error
+	RequeueOrder(ctx context.Context, orderNumber string) (bool, error)
+	GetOrderStats(ctx context.Context) (*models.OrderStats, error)
 
 	// Balance operations
 	GetUserBalance(ctx context.Context, userID int64) (*models.Balance, error)
+	GetUserDataVersion(ctx context.Context, userID int64) (int64, error)
 	WithdrawBalance(ctx context.Context, userID int64, orderNumber string, amount float64) error
 	GetUserWithdrawals(ctx context.Context, userID int64) ([]models.Withdrawal, error)
 
-	// Initialize and close
+	// API key operations
+	CreateAPIKey(ctx context.Context, key *models.APIKey) (int64, error)
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (*models.APIKey, error)
+	GetUserAPIKeys(ctx context.Context, userID int64) ([]models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, userID, keyID int64) (bool, error)
+
+	// Audit log operations
+	CreateAuditEvent(ctx context.Context, event *models.AuditEvent) error
+	GetUserAuditEvents(ctx context.Context, userID int64, limit int) ([]models.AuditEvent, error)
+
+	// Login attempt operations
+	GetLoginAttempt(ctx context.Context, scope, key string) (*models.LoginAttempt, error)
+	ClaimLoginAttempt(ctx context.Context, scope, key string, windowStart time.Time, delays []time.Duration) (*models.LoginAttempt, bool, error)
+	ReleaseLoginAttempt(ctx context.Context, scope, key string) error
+	ResetLoginAttempts(ctx context.Context, scope, key string) error
+	DeleteStaleLoginAttempts(ctx context.Context, before time.Time) (int64, error)
+
+	// Idempotency key operations
+	CreateIdempotencyKey(ctx context.Context, key *models.IdempotencyKey) (bool, error)
+	GetIdempotencyKey(ctx context.Context, userID int64, key string) (*models.IdempotencyKey, error)
+	CompleteIdempotencyKey(ctx context.Context, key *models.IdempotencyKey) error
+	DeleteIdempotencyKey(ctx context.Context, userID int64, key string) error
+	DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error)
+
+	// User event operations
+	GetUserEvents(ctx context.Context, userID, afterID int64, limit int) ([]models.UserEvent, error)
+	GetLatestUserEventID(ctx context.Context, userID int64) (int64, error)
+	DeleteUserEventsBefore(ctx context.Context, before time.Time) (int64, error)
+	ListenUserEvents(ctx context.Context, notify func(userID int64)) error
+
+	// Rate limit operations
+	TakeRateLimitToken(ctx context.Context, key string, capacity, rate float64) (*models.TokenBucket, bool, error)
+	DeleteIdleRateLimitBuckets(ctx context.Context, before time.Time) (int64, error)
+
+	// Leader election
+	NewAdvisoryLock(key int64) AdvisoryLock
+
+	// Initialize, migrate, check and close
 	InitDB(databaseURI string) error
+	Migrate() error
+	Ping(ctx context.Context) error
+	Stats() sql.DBStats
 	Close() error
 }
 
+// ErrOrderAlreadyWithdrawn is returned when an order number has already
+// been paid with points
+var ErrOrderAlreadyWithdrawn = errors.New("order already withdrawn")
+
+// uniqueViolation is the SQLSTATE of a unique constraint violation
+const uniqueViolation = "23505"
+
+// isUniqueViolation reports whether err is a unique constraint violation
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation
+}
+
 // PostgresRepository implements Repository using PostgreSQL
 type PostgresRepository struct {
 	db *sql.DB
@@ -45,7 +121,7 @@ func NewPostgresRepository(databaseURI string) *PostgresRepository {
 	}
 }
 
-// InitDB initializes the database connection and schema
+// InitDB initializes the database connection
 func (r *PostgresRepository) InitDB(databaseURI string) error {
 	db, err := sql.Open("pgx", databaseURI)
 	if err != nil {
@@ -59,15 +135,76 @@ func (r *PostgresRepository) InitDB(databaseURI string) error {
 	}
 
 	r.db = db
+	return nil
+}
+
+// Migrate creates or updates the schema. It is safe to run repeatedly.
+func (r *PostgresRepository) Migrate() error {
+	return r.createTables()
+}
 
-	// Create tables if they don't exist
-	err = r.createTables()
+// maxReportedDuplicates limits the order numbers listed in the error of
+// checkDuplicateWithdrawals
+const maxReportedDuplicates = 20
+
+// checkDuplicateWithdrawals fails with the duplicated order numbers if the
+// unique index on withdrawals is missing and the existing rows would
+// violate it
+func (r *PostgresRepository) checkDuplicateWithdrawals() error {
+	var exists bool
+	err := r.db.QueryRow(`SELECT to_regclass('withdrawals_order_number_key') IS NOT NULL`).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+
+	rows, err := r.db.Query(`
+		SELECT order_number, COUNT(*) FROM withdrawals
+		GROUP BY order_number HAVING COUNT(*) > 1
+		ORDER BY order_number
+		LIMIT $1
+	`, maxReportedDuplicates+1)
 	if err != nil {
-		db.Close()
 		return err
 	}
+	defer rows.Close()
 
-	return nil
+	var duplicates []string
+	for rows.Next() {
+		var orderNumber string
+		var count int
+		if err := rows.Scan(&orderNumber, &count); err != nil {
+			return err
+		}
+		duplicates = append(duplicates, fmt.Sprintf("%s (%d times)", orderNumber, count))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(duplicates) == 0 {
+		return nil
+	}
+
+	if len(duplicates) > maxReportedDuplicates {
+		duplicates = append(duplicates[:maxReportedDuplicates], "...")
+	}
+	return fmt.Errorf("cannot make withdrawal order numbers unique: orders paid more than once: %s; "+
+		"delete the extra withdrawals, which refunds them, then migrate again", strings.Join(duplicates, ", "))
+}
+
+// Ping checks that the database is reachable
+func (r *PostgresRepository) Ping(ctx context.Context) error {
+	if r.db == nil {
+		return errors.New("database is not initialized")
+	}
+	return r.db.PingContext(ctx)
+}
+
+// Stats returns the connection pool statistics
+func (r *PostgresRepository) Stats() sql.DBStats {
+	if r.db == nil {
+		return sql.DBStats{}
+	}
+	return r.db.Stats()
 }
 
 // Close closes the database connection
@@ -122,6 +259,268 @@ func (r *PostgresRepository) createTables() error {
 		return err
 	}
 
+	// Add two-factor authentication columns to users table
+	_, err = r.db.Exec(`
+		ALTER TABLE users
+			ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64),
+			ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+			ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Add role columns to users table
+	_, err = r.db.Exec(`
+		ALTER TABLE users
+			ADD COLUMN IF NOT EXISTS role VARCHAR(16) NOT NULL DEFAULT 'user',
+			ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMP
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Count changes to the orders and withdrawals of each user, for ETags
+	_, err = r.db.Exec(`
+		ALTER TABLE users
+			ADD COLUMN IF NOT EXISTS data_version BIGINT NOT NULL DEFAULT 0
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Keep the trace of the upload request so that accrual processing can
+	// be linked to it
+	_, err = r.db.Exec(`
+		ALTER TABLE orders
+			ADD COLUMN IF NOT EXISTS trace_parent VARCHAR(64) NOT NULL DEFAULT ''
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Workers claim pending orders so that each is checked by one of them
+	_, err = r.db.Exec(`
+		ALTER TABLE orders
+			ADD COLUMN IF NOT EXISTS claimed_until TIMESTAMPTZ
+	`)
+	if err != nil {
+		return err
+	}
+
+	// The age of pending orders is measured with the clock in Go, so upload
+	// times are stored with their time zone. They were set by the database
+	// in the session time zone, which the conversion assumes. Converting a
+	// column that already has the type is a no-op.
+	_, err = r.db.Exec(`
+		ALTER TABLE orders ALTER COLUMN uploaded_at TYPE TIMESTAMPTZ
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create external identities table
+	_, err = r.db.Exec(`
+		CREATE TABLE IF NOT EXISTS external_identities (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id),
+			issuer VARCHAR(255) NOT NULL,
+			subject VARCHAR(255) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (issuer, subject)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create recovery codes table
+	_, err = r.db.Exec(`
+		CREATE TABLE IF NOT EXISTS recovery_codes (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id),
+			code_hash VARCHAR(64) NOT NULL,
+			used_at TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create API keys table
+	_, err = r.db.Exec(`
+		CREATE TABLE IF NOT EXISTS api_keys (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id),
+			name VARCHAR(255) NOT NULL,
+			prefix VARCHAR(16) NOT NULL,
+			key_hash VARCHAR(64) UNIQUE NOT NULL,
+			scopes TEXT NOT NULL,
+			expires_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			revoked_at TIMESTAMPTZ
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Key expiry is given by clients with their own UTC offset and checked
+	// in Go, so the times are stored with their time zone. Converting a
+	// column that already has the type is a no-op.
+	_, err = r.db.Exec(`
+		ALTER TABLE api_keys
+			ALTER COLUMN expires_at TYPE TIMESTAMPTZ,
+			ALTER COLUMN created_at TYPE TIMESTAMPTZ,
+			ALTER COLUMN revoked_at TYPE TIMESTAMPTZ
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create audit events table. Rows can only be inserted; a trigger
+	// rejects updates and deletes.
+	_, err = r.db.Exec(`
+		CREATE TABLE IF NOT EXISTS audit_events (
+			id BIGSERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id),
+			event_type VARCHAR(64) NOT NULL,
+			ip VARCHAR(64) NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			request_id VARCHAR(128) NOT NULL DEFAULT '',
+			details JSONB,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS audit_events_user_id_idx ON audit_events (user_id, created_at DESC);
+		CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit_events is append-only';
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+		CREATE TRIGGER audit_events_append_only
+			BEFORE UPDATE OR DELETE ON audit_events
+			FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create login attempts table
+	_, err = r.db.Exec(`
+		CREATE TABLE IF NOT EXISTS login_attempts (
+			scope VARCHAR(16) NOT NULL,
+			key VARCHAR(255) NOT NULL,
+			failures INTEGER NOT NULL DEFAULT 0,
+			last_failure_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			locked_until TIMESTAMPTZ,
+			PRIMARY KEY (scope, key)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// An order number can be paid with points only once. Withdrawals made
+	// before the index existed may repeat an order; those are real charges,
+	// so they are reported for an operator to resolve rather than dropped.
+	if err := r.checkDuplicateWithdrawals(); err != nil {
+		return err
+	}
+	_, err = r.db.Exec(`
+		CREATE UNIQUE INDEX IF NOT EXISTS withdrawals_order_number_key ON withdrawals (order_number)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create idempotency keys table. A status code of 0 marks a request
+	// that is still being processed.
+	_, err = r.db.Exec(`
+		CREATE TABLE IF NOT EXISTS idempotency_keys (
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			key VARCHAR(255) NOT NULL,
+			request_hash VARCHAR(64) NOT NULL,
+			status_code INTEGER NOT NULL DEFAULT 0,
+			content_type VARCHAR(255) NOT NULL DEFAULT '',
+			body BYTEA,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY (user_id, key)
+		);
+		CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Key expiry is compared with the clock in Go, so the times are stored
+	// with their time zone. Converting a column that already has the type
+	// is a no-op.
+	_, err = r.db.Exec(`
+		ALTER TABLE idempotency_keys
+			ALTER COLUMN created_at TYPE TIMESTAMPTZ,
+			ALTER COLUMN expires_at TYPE TIMESTAMPTZ
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create user events table, streamed to clients
+	_, err = r.db.Exec(`
+		CREATE TABLE IF NOT EXISTS user_events (
+			id BIGSERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			type VARCHAR(32) NOT NULL,
+			data JSONB NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS user_events_user_id_idx ON user_events (user_id, id);
+		CREATE INDEX IF NOT EXISTS user_events_created_at_idx ON user_events (created_at);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Retention compares event times with the clock in Go, so they are
+	// stored with their time zone. Existing times were set by the database
+	// in the session time zone, which the conversion assumes. Converting a
+	// column that already has the type is a no-op.
+	_, err = r.db.Exec(`
+		ALTER TABLE user_events ALTER COLUMN created_at TYPE TIMESTAMPTZ
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create rate limit buckets table, used by the postgres rate limit
+	// backend
+	_, err = r.db.Exec(`
+		CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+			key VARCHAR(255) PRIMARY KEY,
+			tokens DOUBLE PRECISION NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Lockout and rate limit times are read back and compared with the
+	// clock in Go, so they are stored with their time zone; without one
+	// they came back shifted by the host's UTC offset. Converting a column
+	// that already has the type is a no-op.
+	_, err = r.db.Exec(`
+		ALTER TABLE login_attempts
+			ALTER COLUMN last_failure_at TYPE TIMESTAMPTZ,
+			ALTER COLUMN locked_until TYPE TIMESTAMPTZ;
+		ALTER TABLE rate_limit_buckets
+			ALTER COLUMN updated_at TYPE TIMESTAMPTZ;
+	`)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -142,13 +541,13 @@ func (r *PostgresRepository) CreateUser(ctx context.Context, login, passwordHash
 }
 
 func (r *PostgresRepository) GetUserByLogin(ctx context.Context, login string) (*models.User, error) {
-	user := &models.User{}
-	err := r.db.QueryRowContext(
+	row := r.db.QueryRowContext(
 		ctx,
-		"SELECT id, login, password_hash, created_at FROM users WHERE login = $1",
+		"SELECT "+userColumns+" FROM users WHERE login = $1",
 		login,
-	).Scan(&user.ID, &user.Login, &user.PasswordHash, &user.CreatedAt)
+	)
 
+	user, err := scanUser(row)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -160,13 +559,13 @@ func (r *PostgresRepository) GetUserByLogin(ctx context.Context, login string) (
 }
 
 func (r *PostgresRepository) GetUserByID(ctx context.Context, id int64) (*models.User, error) {
-	user := &models.User{}
-	err := r.db.QueryRowContext(
+	row := r.db.QueryRowContext(
 		ctx,
-		"SELECT id, login, password_hash, created_at FROM users WHERE id = $1",
+		"SELECT "+userColumns+" FROM users WHERE id = $1",
 		id,
-	).Scan(&user.ID, &user.Login, &user.PasswordHash, &user.CreatedAt)
+	)
 
+	user, err := scanUser(row)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -177,24 +576,26 @@ func (r *PostgresRepository) GetUserByID(ctx context.Context, id int64) (*models
 	return user, nil
 }
 
-// Order repository methods
-func (r *PostgresRepository) CreateOrder(ctx context.Context, userID int64, orderNumber string) error {
+func (r *PostgresRepository) UpdateUserPasswordHash(ctx context.Context, userID int64, passwordHash string) error {
 	_, err := r.db.ExecContext(
 		ctx,
-		"INSERT INTO orders (user_id, number, status) VALUES ($1, $2, $3)",
-		userID, orderNumber, models.StatusNew,
+		"UPDATE users SET password_hash = $1 WHERE id = $2",
+		passwordHash, userID,
 	)
 	return err
 }
 
-func (r *PostgresRepository) GetOrderByNumber(ctx context.Context, orderNumber string) (*models.Order, error) {
-	order := &models.Order{}
-	err := r.db.QueryRowContext(
+// GetUserByExternalIdentity returns the user linked to an identity provider subject
+func (r *PostgresRepository) GetUserByExternalIdentity(ctx context.Context, issuer, subject string) (*models.User, error) {
+	row := r.db.QueryRowContext(
 		ctx,
-		"SELECT id, number, user_id, status, accrual, uploaded_at FROM orders WHERE number = $1",
-		orderNumber,
-	).Scan(&order.ID, &order.Number, &order.UserID, &order.Status, &order.Accrual, &order.UploadedAt)
+		`SELECT `+userColumns+`
+         FROM users
+         WHERE id = (SELECT user_id FROM external_identities WHERE issuer = $1 AND subject = $2)`,
+		issuer, subject,
+	)
 
+	user, err := scanUser(row)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -202,110 +603,593 @@ func (r *PostgresRepository) GetOrderByNumber(ctx context.Context, orderNumber s
 		return nil, err
 	}
 
-	return order, nil
+	return user, nil
 }
 
-func (r *PostgresRepository) GetUserOrders(ctx context.Context, userID int64) ([]models.Order, error) {
+// CreateExternalUser creates a user without a password and links it to an
+// identity provider subject
+func (r *PostgresRepository) CreateExternalUser(ctx context.Context, login, issuer, subject string) (int64, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRowContext(
+		ctx,
+		"INSERT INTO users (login, password_hash) VALUES ($1, '') RETURNING id",
+		login,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO external_identities (user_id, issuer, subject) VALUES ($1, $2, $3)",
+		id, issuer, subject,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// likeEscaper escapes the LIKE wildcards and the escape character itself
+var likeEscaper = strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+
+// SearchUsers returns users whose login contains the query. The query is
+// matched literally, so % and _ in it are not wildcards.
+func (r *PostgresRepository) SearchUsers(ctx context.Context, loginQuery string, limit int) ([]models.User, error) {
 	rows, err := r.db.QueryContext(
 		ctx,
-		`SELECT id, number, user_id, status, accrual, uploaded_at 
-         FROM orders 
-         WHERE user_id = $1
-         ORDER BY uploaded_at DESC`,
-		userID,
+		`SELECT `+userColumns+`
+         FROM users
+         WHERE login ILIKE '%' || $1 || '%' ESCAPE '\'
+         ORDER BY login
+         LIMIT $2`,
+		likeEscaper.Replace(loginQuery), limit,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var orders []models.Order
+	var users []models.User
 	for rows.Next() {
-		var order models.Order
-		if err := rows.Scan(
-			&order.ID,
-			&order.Number,
-			&order.UserID,
-			&order.Status,
-			&order.Accrual,
-			&order.UploadedAt,
-		); err != nil {
+		user, err := scanUser(rows)
+		if err != nil {
 			return nil, err
 		}
-		orders = append(orders, order)
+		users = append(users, *user)
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
 
-	return orders, nil
+	return users, nil
 }
 
-func (r *PostgresRepository) UpdateOrderStatus(ctx context.Context, orderNumber, status string, accrual float64) error {
+func (r *PostgresRepository) SetUserRole(ctx context.Context, userID int64, role string) error {
 	_, err := r.db.ExecContext(
 		ctx,
-		"UPDATE orders SET status = $1, accrual = $2 WHERE number = $3",
-		status, accrual, orderNumber,
+		"UPDATE users SET role = $1 WHERE id = $2",
+		role, userID,
 	)
 	return err
 }
 
-// Balance repository methods
-func (r *PostgresRepository) GetUserBalance(ctx context.Context, userID int64) (*models.Balance, error) {
-	balance := &models.Balance{}
+func (r *PostgresRepository) SetUserDisabled(ctx context.Context, userID int64, disabled bool) error {
+	var disabledAt *time.Time
+	if disabled {
+		now := time.Now()
+		disabledAt = &now
+	}
 
-	// Get current balance (sum of all processed orders minus withdrawals)
-	err := r.db.QueryRowContext(
+	_, err := r.db.ExecContext(
 		ctx,
-		`SELECT 
-            COALESCE(SUM(accrual), 0) 
-         FROM orders 
-         WHERE user_id = $1 AND status = $2`,
-		userID, models.StatusProcessed,
-	).Scan(&balance.Current)
-	if err != nil {
+		"UPDATE users SET disabled_at = $1 WHERE id = $2",
+		disabledAt, userID,
+	)
+	return err
+}
+
+// userColumns lists the columns read by scanUser
+const userColumns = `id, login, password_hash, COALESCE(totp_secret, ''), totp_enabled, role, disabled_at, created_at`
+
+func scanUser(row rowScanner) (*models.User, error) {
+	user := &models.User{}
+	var disabledAt sql.NullTime
+	if err := row.Scan(
+		&user.ID,
+		&user.Login,
+		&user.PasswordHash,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
+		&user.Role,
+		&disabledAt,
+		&user.CreatedAt,
+	); err != nil {
 		return nil, err
 	}
 
-	// Get total withdrawals
-	err = r.db.QueryRowContext(
-		ctx,
-		`SELECT 
-            COALESCE(SUM(sum), 0) 
-         FROM withdrawals 
-         WHERE user_id = $1`,
-		userID,
-	).Scan(&balance.Withdrawn)
-	if err != nil {
-		return nil, err
+	if disabledAt.Valid {
+		user.DisabledAt = &disabledAt.Time
 	}
 
-	// Subtract withdrawn amount from current balance
+	return user, nil
+}
+
+// Two-factor authentication repository methods
+
+// SetUserTOTPSecret stores a pending TOTP secret; it is not enforced until
+// EnableUserTOTP is called
+func (r *PostgresRepository) SetUserTOTPSecret(ctx context.Context, userID int64, secret string) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		"UPDATE users SET totp_secret = $1, totp_enabled = FALSE WHERE id = $2",
+		secret, userID,
+	)
+	return err
+}
+
+// EnableUserTOTP enables two-factor authentication and replaces recovery codes
+func (r *PostgresRepository) EnableUserTOTP(ctx context.Context, userID int64, recoveryCodeHashes []string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET totp_enabled = TRUE WHERE id = $1", userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	for _, hash := range recoveryCodeHashes {
+		if _, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+			userID, hash,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DisableUserTOTP disables two-factor authentication and drops recovery codes
+func (r *PostgresRepository) DisableUserTOTP(ctx context.Context, userID int64) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = 0 WHERE id = $1",
+		userID,
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep marks the TOTP time step as used. It returns false if the
+// step, or a later one, has already been used.
+func (r *PostgresRepository) UseTOTPStep(ctx context.Context, userID int64, step int64) (bool, error) {
+	res, err := r.db.ExecContext(
+		ctx,
+		"UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1",
+		step, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UseRecoveryCode marks an unused recovery code as used
+func (r *PostgresRepository) UseRecoveryCode(ctx context.Context, userID int64, codeHash string) (bool, error) {
+	res, err := r.db.ExecContext(
+		ctx,
+		"UPDATE recovery_codes SET used_at = $1 WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL",
+		time.Now(), userID, codeHash,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Order repository methods
+func (r *PostgresRepository) CreateOrder(ctx context.Context, userID int64, orderNumber string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	order := models.Order{Number: orderNumber, UserID: userID, Status: models.StatusNew}
+	err = tx.QueryRowContext(
+		ctx,
+		"INSERT INTO orders (user_id, number, status, trace_parent) VALUES ($1, $2, $3, $4) RETURNING uploaded_at",
+		userID, orderNumber, models.StatusNew, tracing.Inject(ctx),
+	).Scan(&order.UploadedAt)
+	if err != nil {
+		return err
+	}
+
+	if err := bumpDataVersion(ctx, tx, order.UserID); err != nil {
+		return err
+	}
+	if err := addOrderEvents(ctx, tx, &order); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *PostgresRepository) GetOrderByNumber(ctx context.Context, orderNumber string) (*models.Order, error) {
+	order := &models.Order{}
+	err := r.db.QueryRowContext(
+		ctx,
+		"SELECT id, number, user_id, status, accrual, uploaded_at FROM orders WHERE number = $1",
+		orderNumber,
+	).Scan(&order.ID, &order.Number, &order.UserID, &order.Status, &order.Accrual, &order.UploadedAt)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return order, nil
+}
+
+func (r *PostgresRepository) GetUserOrders(ctx context.Context, userID int64) ([]models.Order, error) {
+	rows, err := r.db.QueryContext(
+		ctx,
+		`SELECT id, number, user_id, status, accrual, uploaded_at 
+         FROM orders 
+         WHERE user_id = $1
+         ORDER BY uploaded_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []models.Order
+	for rows.Next() {
+		var order models.Order
+		if err := rows.Scan(
+			&order.ID,
+			&order.Number,
+			&order.UserID,
+			&order.Status,
+			&order.Accrual,
+			&order.UploadedAt,
+		); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return orders, nil
+}
+
+// UpdateOrderStatus sets the status and accrual of an order and, if they
+// changed, records the events of the change
+func (r *PostgresRepository) UpdateOrderStatus(ctx context.Context, orderNumber, status string, accrual float64) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	order := models.Order{Number: orderNumber, Status: status, Accrual: accrual}
+	err = tx.QueryRowContext(
+		ctx,
+		`UPDATE orders SET status = $1, accrual = $2
+         WHERE number = $3 AND (status <> $1 OR accrual IS DISTINCT FROM $2)
+         RETURNING user_id, uploaded_at`,
+		status, accrual, orderNumber,
+	).Scan(&order.UserID, &order.UploadedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Unchanged
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := bumpDataVersion(ctx, tx, order.UserID); err != nil {
+		return err
+	}
+	if err := addOrderEvents(ctx, tx, &order); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetOrderStats counts orders per status and finds the oldest pending order
+func (r *PostgresRepository) GetOrderStats(ctx context.Context) (*models.OrderStats, error) {
+	rows, err := r.db.QueryContext(
+		ctx,
+		`SELECT status, COUNT(*), MIN(uploaded_at) FROM orders GROUP BY status`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := &models.OrderStats{CountByStatus: make(map[string]int64)}
+	for rows.Next() {
+		var status string
+		var count int64
+		var oldest time.Time
+		if err := rows.Scan(&status, &count, &oldest); err != nil {
+			return nil, err
+		}
+		stats.CountByStatus[status] = count
+
+		pending := status == models.StatusNew || status == models.StatusProcessing
+		if pending && (stats.OldestPending == nil || oldest.Before(*stats.OldestPending)) {
+			stats.OldestPending = &oldest
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// ClaimPendingOrders claims up to limit orders that still wait for a final
+// accrual status and are not claimed by another worker. The claim expires
+// after lease, so the orders of a worker that dies are picked up again.
+// Rows locked by a worker claiming concurrently are skipped rather than
+// waited for.
+func (r *PostgresRepository) ClaimPendingOrders(ctx context.Context, limit int, lease time.Duration) ([]models.Order, error) {
+	rows, err := r.db.QueryContext(
+		ctx,
+		`UPDATE orders SET claimed_until = NOW() + $4 * INTERVAL '1 millisecond'
+         WHERE id IN (
+             SELECT id FROM orders
+             WHERE status IN ($1, $2) AND (claimed_until IS NULL OR claimed_until < NOW())
+             ORDER BY uploaded_at
+             LIMIT $3
+             FOR UPDATE SKIP LOCKED
+         )
+         RETURNING id, number, user_id, status, accrual, uploaded_at, trace_parent`,
+		models.StatusNew, models.StatusProcessing, limit, lease.Milliseconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []models.Order
+	for rows.Next() {
+		var order models.Order
+		if err := rows.Scan(
+			&order.ID,
+			&order.Number,
+			&order.UserID,
+			&order.Status,
+			&order.Accrual,
+			&order.UploadedAt,
+			&order.TraceParent,
+		); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return orders, nil
+}
+
+// ReleaseOrderClaims releases the claims on the orders so that they can be
+// claimed again right away
+func (r *PostgresRepository) ReleaseOrderClaims(ctx context.Context, orderNumbers []string) error {
+	_, err := r.db.ExecContext(ctx, "UPDATE orders SET claimed_until = NULL WHERE number = ANY($1)", orderNumbers)
+	return err
+}
+
+// RequeueOrder resets an unprocessed order to NEW so that the worker picks
+// it up again. Processed orders are left untouched.
+func (r *PostgresRepository) RequeueOrder(ctx context.Context, orderNumber string) (bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	order := models.Order{Number: orderNumber, Status: models.StatusNew}
+	err = tx.QueryRowContext(
+		ctx,
+		"UPDATE orders SET status = $1, accrual = 0 WHERE number = $2 AND status <> $3 RETURNING user_id, uploaded_at",
+		models.StatusNew, orderNumber, models.StatusProcessed,
+	).Scan(&order.UserID, &order.UploadedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := bumpDataVersion(ctx, tx, order.UserID); err != nil {
+		return false, err
+	}
+	if err := addOrderEvents(ctx, tx, &order); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// Balance repository methods
+func (r *PostgresRepository) GetUserBalance(ctx context.Context, userID int64) (*models.Balance, error) {
+	return userBalance(ctx, r.db, userID)
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// bumpDataVersion increments the data version of the user. It must be
+// called in every transaction changing the user's orders or withdrawals, so
+// that an unchanged version means unchanged data.
+func bumpDataVersion(ctx context.Context, tx *sql.Tx, userID int64) error {
+	_, err := tx.ExecContext(ctx, "UPDATE users SET data_version = data_version + 1 WHERE id = $1", userID)
+	return err
+}
+
+// GetUserDataVersion returns the data version of the user, which changes
+// whenever their orders or withdrawals do
+func (r *PostgresRepository) GetUserDataVersion(ctx context.Context, userID int64) (int64, error) {
+	var version int64
+	err := r.db.QueryRowContext(ctx, "SELECT data_version FROM users WHERE id = $1", userID).Scan(&version)
+	return version, err
+}
+
+// userBalance computes the balance of the user, inside a transaction if q
+// is one
+func userBalance(ctx context.Context, q queryRower, userID int64) (*models.Balance, error) {
+	balance := &models.Balance{}
+
+	// Get current balance (sum of all processed orders minus withdrawals)
+	err := q.QueryRowContext(
+		ctx,
+		`SELECT 
+            COALESCE(SUM(accrual), 0) 
+         FROM orders 
+         WHERE user_id = $1 AND status = $2`,
+		userID, models.StatusProcessed,
+	).Scan(&balance.Current)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get total withdrawals
+	err = q.QueryRowContext(
+		ctx,
+		`SELECT 
+            COALESCE(SUM(sum), 0) 
+         FROM withdrawals 
+         WHERE user_id = $1`,
+		userID,
+	).Scan(&balance.Withdrawn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Subtract withdrawn amount from current balance
 	balance.Current -= balance.Withdrawn
 
 	return balance, nil
 }
 
+// WithdrawBalance debits the user's balance for an order. Concurrent
+// withdrawals of the same user are serialized on the user row, so the
+// balance can't be spent twice.
 func (r *PostgresRepository) WithdrawBalance(ctx context.Context, userID int64, orderNumber string, amount float64) error {
-	// Get current balance
-	balance, err := r.GetUserBalance(ctx, userID)
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT id FROM users WHERE id = $1 FOR UPDATE", userID); err != nil {
+		return err
+	}
+
+	// Check the order hasn't been paid for already
+	var exists bool
+	err = tx.QueryRowContext(
+		ctx,
+		"SELECT EXISTS (SELECT 1 FROM withdrawals WHERE order_number = $1)",
+		orderNumber,
+	).Scan(&exists)
 	if err != nil {
 		return err
 	}
+	if exists {
+		return ErrOrderAlreadyWithdrawn
+	}
 
 	// Check if enough funds
-	if balance.Current < amount {
+	var current float64
+	err = tx.QueryRowContext(
+		ctx,
+		`SELECT
+            (SELECT COALESCE(SUM(accrual), 0) FROM orders WHERE user_id = $1 AND status = $2) -
+            (SELECT COALESCE(SUM(sum), 0) FROM withdrawals WHERE user_id = $1)`,
+		userID, models.StatusProcessed,
+	).Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current < amount {
 		return errors.New("insufficient funds")
 	}
 
 	// Create withdrawal record
-	_, err = r.db.ExecContext(
+	_, err = tx.ExecContext(
 		ctx,
 		"INSERT INTO withdrawals (user_id, order_number, sum, processed_at) VALUES ($1, $2, $3, $4)",
 		userID, orderNumber, amount, time.Now(),
 	)
-	return err
+	if isUniqueViolation(err) {
+		// Another user paid for the same order concurrently
+		return ErrOrderAlreadyWithdrawn
+	}
+	if err != nil {
+		return err
+	}
+	if err := bumpDataVersion(ctx, tx, userID); err != nil {
+		return err
+	}
+
+	balance, err := userBalance(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	if err := addUserEvent(ctx, tx, userID, models.UserEventBalanceChanged, balance); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func (r *PostgresRepository) GetUserWithdrawals(ctx context.Context, userID int64) ([]models.Withdrawal, error) {
@@ -345,3 +1229,426 @@ func (r *PostgresRepository) GetUserWithdrawals(ctx context.Context, userID int6
 
 	return withdrawals, nil
 }
+
+// API key repository methods
+func (r *PostgresRepository) CreateAPIKey(ctx context.Context, key *models.APIKey) (int64, error) {
+	var id int64
+	err := r.db.QueryRowContext(
+		ctx,
+		`INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+         VALUES ($1, $2, $3, $4, $5, $6)
+         RETURNING id, created_at`,
+		key.UserID, key.Name, key.Prefix, key.KeyHash, strings.Join(key.Scopes, ","), key.ExpiresAt,
+	).Scan(&id, &key.CreatedAt)
+
+	if err != nil {
+		return 0, err
+	}
+
+	key.ID = id
+	return id, nil
+}
+
+func (r *PostgresRepository) GetAPIKeyByHash(ctx context.Context, keyHash string) (*models.APIKey, error) {
+	row := r.db.QueryRowContext(
+		ctx,
+		`SELECT id, user_id, name, prefix, key_hash, scopes, expires_at, created_at, revoked_at
+         FROM api_keys
+         WHERE key_hash = $1`,
+		keyHash,
+	)
+
+	key, err := scanAPIKey(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (r *PostgresRepository) GetUserAPIKeys(ctx context.Context, userID int64) ([]models.APIKey, error) {
+	rows, err := r.db.QueryContext(
+		ctx,
+		`SELECT id, user_id, name, prefix, key_hash, scopes, expires_at, created_at, revoked_at
+         FROM api_keys
+         WHERE user_id = $1
+         ORDER BY created_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []models.APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (r *PostgresRepository) RevokeAPIKey(ctx context.Context, userID, keyID int64) (bool, error) {
+	res, err := r.db.ExecContext(
+		ctx,
+		"UPDATE api_keys SET revoked_at = $1 WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL",
+		time.Now(), keyID, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAPIKey(row rowScanner) (*models.APIKey, error) {
+	key := &models.APIKey{}
+	var scopes string
+	var expiresAt, revokedAt sql.NullTime
+	if err := row.Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		&key.KeyHash,
+		&scopes,
+		&expiresAt,
+		&key.CreatedAt,
+		&revokedAt,
+	); err != nil {
+		return nil, err
+	}
+
+	if scopes != "" {
+		key.Scopes = strings.Split(scopes, ",")
+	}
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+
+	return key, nil
+}
+
+// Audit log repository methods
+func (r *PostgresRepository) CreateAuditEvent(ctx context.Context, event *models.AuditEvent) error {
+	var details []byte
+	if len(event.Details) > 0 {
+		var err error
+		details, err = json.Marshal(event.Details)
+		if err != nil {
+			return err
+		}
+	}
+
+	var userID sql.NullInt64
+	if event.UserID != 0 {
+		userID = sql.NullInt64{Int64: event.UserID, Valid: true}
+	}
+
+	return r.db.QueryRowContext(
+		ctx,
+		`INSERT INTO audit_events (user_id, event_type, ip, user_agent, request_id, details)
+         VALUES ($1, $2, $3, $4, $5, $6)
+         RETURNING id, created_at`,
+		userID, event.Type, event.IP, event.UserAgent, event.RequestID, details,
+	).Scan(&event.ID, &event.CreatedAt)
+}
+
+func (r *PostgresRepository) GetUserAuditEvents(ctx context.Context, userID int64, limit int) ([]models.AuditEvent, error) {
+	rows, err := r.db.QueryContext(
+		ctx,
+		`SELECT id, user_id, event_type, ip, user_agent, request_id, details, created_at
+         FROM audit_events
+         WHERE user_id = $1
+         ORDER BY created_at DESC, id DESC
+         LIMIT $2`,
+		userID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []models.AuditEvent
+	for rows.Next() {
+		var event models.AuditEvent
+		var details []byte
+		if err := rows.Scan(
+			&event.ID,
+			&event.UserID,
+			&event.Type,
+			&event.IP,
+			&event.UserAgent,
+			&event.RequestID,
+			&details,
+			&event.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		if len(details) > 0 {
+			if err := json.Unmarshal(details, &event.Details); err != nil {
+				return nil, err
+			}
+		}
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// Login attempt repository methods
+func (r *PostgresRepository) GetLoginAttempt(ctx context.Context, scope, key string) (*models.LoginAttempt, error) {
+	attempt := &models.LoginAttempt{Scope: scope, Key: key}
+	var lockedUntil sql.NullTime
+	err := r.db.QueryRowContext(
+		ctx,
+		"SELECT failures, last_failure_at, locked_until FROM login_attempts WHERE scope = $1 AND key = $2",
+		scope, key,
+	).Scan(&attempt.Failures, &attempt.LastFailureAt, &lockedUntil)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if lockedUntil.Valid {
+		attempt.LockedUntil = &lockedUntil.Time
+	}
+
+	return attempt, nil
+}
+
+// ClaimLoginAttempt counts an attempt as failed unless the key is locked,
+// and locks the key for delays[n-1] after the n-th failure, the last delay
+// applying from len(delays) failures on. The counter restarts when the
+// previous failure happened before windowStart or the key has been locked
+// out. Admitting the attempt and setting the lock is one statement, so
+// concurrent attempts each see the lock of the one before. It returns
+// false and the current state if the key is locked.
+func (r *PostgresRepository) ClaimLoginAttempt(ctx context.Context, scope, key string, windowStart time.Time, delays []time.Duration) (*models.LoginAttempt, bool, error) {
+	delaysMs := make([]int64, len(delays))
+	for i, d := range delays {
+		delaysMs[i] = d.Milliseconds()
+	}
+
+	attempt := &models.LoginAttempt{Scope: scope, Key: key}
+	var lockedUntil sql.NullTime
+	err := r.db.QueryRowContext(
+		ctx,
+		`INSERT INTO login_attempts AS a (scope, key, failures, last_failure_at, locked_until)
+         VALUES ($1, $2, 1, $3::TIMESTAMPTZ, $3::TIMESTAMPTZ + NULLIF(($5::BIGINT[])[1], 0) * INTERVAL '1 millisecond')
+         ON CONFLICT (scope, key) DO UPDATE SET
+            failures = CASE
+                WHEN a.last_failure_at < $4 OR a.failures >= cardinality($5::BIGINT[]) THEN 1
+                ELSE a.failures + 1
+            END,
+            last_failure_at = EXCLUDED.last_failure_at,
+            locked_until = EXCLUDED.last_failure_at + NULLIF(($5::BIGINT[])[CASE
+                WHEN a.last_failure_at < $4 OR a.failures >= cardinality($5::BIGINT[]) THEN 1
+                ELSE a.failures + 1
+            END], 0) * INTERVAL '1 millisecond'
+         WHERE a.locked_until IS NULL OR a.locked_until <= EXCLUDED.last_failure_at
+         RETURNING failures, last_failure_at, locked_until`,
+		scope, key, time.Now(), windowStart, delaysMs,
+	).Scan(&attempt.Failures, &attempt.LastFailureAt, &lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The key is locked; read the lock for the caller
+		attempt, err := r.GetLoginAttempt(ctx, scope, key)
+		return attempt, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if lockedUntil.Valid {
+		attempt.LockedUntil = &lockedUntil.Time
+	}
+
+	return attempt, true, nil
+}
+
+// ReleaseLoginAttempt takes back an attempt counted by ClaimLoginAttempt.
+// A lock set by it stays in place: by then other attempts may rely on it.
+func (r *PostgresRepository) ReleaseLoginAttempt(ctx context.Context, scope, key string) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		"UPDATE login_attempts SET failures = GREATEST(failures - 1, 0) WHERE scope = $1 AND key = $2",
+		scope, key,
+	)
+	return err
+}
+
+func (r *PostgresRepository) ResetLoginAttempts(ctx context.Context, scope, key string) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		"DELETE FROM login_attempts WHERE scope = $1 AND key = $2",
+		scope, key,
+	)
+	return err
+}
+
+// DeleteStaleLoginAttempts deletes attempts whose last failure is older
+// than before and that are not locked
+func (r *PostgresRepository) DeleteStaleLoginAttempts(ctx context.Context, before time.Time) (int64, error) {
+	res, err := r.db.ExecContext(
+		ctx,
+		"DELETE FROM login_attempts WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < $2)",
+		before, time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// CreateIdempotencyKey claims the key for a new request. It returns false
+// if the key is already in use and hasn't expired.
+func (r *PostgresRepository) CreateIdempotencyKey(ctx context.Context, key *models.IdempotencyKey) (bool, error) {
+	err := r.db.QueryRowContext(
+		ctx,
+		`INSERT INTO idempotency_keys (user_id, key, request_hash, created_at, expires_at)
+         VALUES ($1, $2, $3, $4, $5)
+         ON CONFLICT (user_id, key) DO UPDATE SET
+            request_hash = EXCLUDED.request_hash,
+            status_code = 0,
+            content_type = '',
+            body = NULL,
+            created_at = EXCLUDED.created_at,
+            expires_at = EXCLUDED.expires_at
+         WHERE idempotency_keys.expires_at < EXCLUDED.created_at
+         RETURNING created_at`,
+		key.UserID, key.Key, key.RequestHash, time.Now(), key.ExpiresAt,
+	).Scan(&key.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *PostgresRepository) GetIdempotencyKey(ctx context.Context, userID int64, key string) (*models.IdempotencyKey, error) {
+	k := &models.IdempotencyKey{UserID: userID, Key: key}
+	err := r.db.QueryRowContext(
+		ctx,
+		`SELECT request_hash, status_code, content_type, body, created_at, expires_at
+         FROM idempotency_keys
+         WHERE user_id = $1 AND key = $2`,
+		userID, key,
+	).Scan(&k.RequestHash, &k.StatusCode, &k.ContentType, &k.Body, &k.CreatedAt, &k.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return k, nil
+}
+
+// CompleteIdempotencyKey stores the response of the request
+func (r *PostgresRepository) CompleteIdempotencyKey(ctx context.Context, key *models.IdempotencyKey) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		`UPDATE idempotency_keys SET status_code = $1, content_type = $2, body = $3
+         WHERE user_id = $4 AND key = $5`,
+		key.StatusCode, key.ContentType, key.Body, key.UserID, key.Key,
+	)
+	return err
+}
+
+func (r *PostgresRepository) DeleteIdempotencyKey(ctx context.Context, userID int64, key string) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		"DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2",
+		userID, key,
+	)
+	return err
+}
+
+func (r *PostgresRepository) DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at < $1", time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// TakeRateLimitToken takes a token from the bucket, creating a full one if
+// it doesn't exist. The bucket row is locked, so replicas sharing it can't
+// take the same token.
+func (r *PostgresRepository) TakeRateLimitToken(ctx context.Context, key string, capacity, rate float64) (*models.TokenBucket, bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO rate_limit_buckets (key, tokens, updated_at) VALUES ($1, $2, $3) ON CONFLICT (key) DO NOTHING",
+		key, capacity, now,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+
+	bucket := &models.TokenBucket{}
+	err = tx.QueryRowContext(
+		ctx,
+		"SELECT tokens, updated_at FROM rate_limit_buckets WHERE key = $1 FOR UPDATE",
+		key,
+	).Scan(&bucket.Tokens, &bucket.UpdatedAt)
+	if err != nil {
+		return nil, false, err
+	}
+
+	allowed := bucket.Take(capacity, rate, now)
+	_, err = tx.ExecContext(
+		ctx,
+		"UPDATE rate_limit_buckets SET tokens = $1, updated_at = $2 WHERE key = $3",
+		bucket.Tokens, bucket.UpdatedAt, key,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return bucket, allowed, tx.Commit()
+}
+
+// DeleteIdleRateLimitBuckets deletes buckets last used before the given
+// time
+func (r *PostgresRepository) DeleteIdleRateLimitBuckets(ctx context.Context, before time.Time) (int64, error) {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM rate_limit_buckets WHERE updated_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
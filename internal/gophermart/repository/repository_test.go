@@ -0,0 +1,24 @@
+package repository
+
+import "testing"
+
+func TestLikeEscaper(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: "alice", want: "alice"},
+		{query: "100%", want: `100\%`},
+		{query: "a_b", want: `a\_b`},
+		{query: `back\slash`, want: `back\\slash`},
+		{query: `\%_`, want: `\\\%\_`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := likeEscaper.Replace(tt.query); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,389 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// dbSystem marks repository spans as PostgreSQL calls
+var dbSystem = trace.WithAttributes(semconv.DBSystemPostgreSQL)
+
+// tracedRepository records a span for each repository call
+type tracedRepository struct {
+	next Repository
+}
+
+// NewTracedRepository wraps a repository so that every call taking a
+// context is traced as part of the caller's trace
+func NewTracedRepository(next Repository) Repository {
+	return &tracedRepository{next: next}
+}
+
+func (r *tracedRepository) CreateUser(ctx context.Context, login, passwordHash string) (int64, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.CreateUser", dbSystem)
+	res, err := r.next.CreateUser(ctx, login, passwordHash)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) GetUserByLogin(ctx context.Context, login string) (*models.User, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.GetUserByLogin", dbSystem)
+	res, err := r.next.GetUserByLogin(ctx, login)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) GetUserByID(ctx context.Context, id int64) (*models.User, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.GetUserByID", dbSystem)
+	res, err := r.next.GetUserByID(ctx, id)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) UpdateUserPasswordHash(ctx context.Context, userID int64, passwordHash string) error {
+	ctx, span := tracing.StartChild(ctx, "repository.UpdateUserPasswordHash", dbSystem)
+	err := r.next.UpdateUserPasswordHash(ctx, userID, passwordHash)
+	tracing.End(span, err)
+	return err
+}
+
+func (r *tracedRepository) GetUserByExternalIdentity(ctx context.Context, issuer, subject string) (*models.User, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.GetUserByExternalIdentity", dbSystem)
+	res, err := r.next.GetUserByExternalIdentity(ctx, issuer, subject)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) CreateExternalUser(ctx context.Context, login, issuer, subject string) (int64, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.CreateExternalUser", dbSystem)
+	res, err := r.next.CreateExternalUser(ctx, login, issuer, subject)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) SearchUsers(ctx context.Context, loginQuery string, limit int) ([]models.User, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.SearchUsers", dbSystem)
+	res, err := r.next.SearchUsers(ctx, loginQuery, limit)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) SetUserRole(ctx context.Context, userID int64, role string) error {
+	ctx, span := tracing.StartChild(ctx, "repository.SetUserRole", dbSystem)
+	err := r.next.SetUserRole(ctx, userID, role)
+	tracing.End(span, err)
+	return err
+}
+
+func (r *tracedRepository) SetUserDisabled(ctx context.Context, userID int64, disabled bool) error {
+	ctx, span := tracing.StartChild(ctx, "repository.SetUserDisabled", dbSystem)
+	err := r.next.SetUserDisabled(ctx, userID, disabled)
+	tracing.End(span, err)
+	return err
+}
+
+func (r *tracedRepository) SetUserTOTPSecret(ctx context.Context, userID int64, secret string) error {
+	ctx, span := tracing.StartChild(ctx, "repository.SetUserTOTPSecret", dbSystem)
+	err := r.next.SetUserTOTPSecret(ctx, userID, secret)
+	tracing.End(span, err)
+	return err
+}
+
+func (r *tracedRepository) EnableUserTOTP(ctx context.Context, userID int64, recoveryCodeHashes []string) error {
+	ctx, span := tracing.StartChild(ctx, "repository.EnableUserTOTP", dbSystem)
+	err := r.next.EnableUserTOTP(ctx, userID, recoveryCodeHashes)
+	tracing.End(span, err)
+	return err
+}
+
+func (r *tracedRepository) DisableUserTOTP(ctx context.Context, userID int64) error {
+	ctx, span := tracing.StartChild(ctx, "repository.DisableUserTOTP", dbSystem)
+	err := r.next.DisableUserTOTP(ctx, userID)
+	tracing.End(span, err)
+	return err
+}
+
+func (r *tracedRepository) UseTOTPStep(ctx context.Context, userID int64, step int64) (bool, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.UseTOTPStep", dbSystem)
+	res, err := r.next.UseTOTPStep(ctx, userID, step)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) UseRecoveryCode(ctx context.Context, userID int64, codeHash string) (bool, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.UseRecoveryCode", dbSystem)
+	res, err := r.next.UseRecoveryCode(ctx, userID, codeHash)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) CreateOrder(ctx context.Context, userID int64, orderNumber string) error {
+	ctx, span := tracing.StartChild(ctx, "repository.CreateOrder", dbSystem)
+	err := r.next.CreateOrder(ctx, userID, orderNumber)
+	tracing.End(span, err)
+	return err
+}
+
+func (r *tracedRepository) GetOrderByNumber(ctx context.Context, orderNumber string) (*models.Order, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.GetOrderByNumber", dbSystem)
+	res, err := r.next.GetOrderByNumber(ctx, orderNumber)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) GetUserOrders(ctx context.Context, userID int64) ([]models.Order, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.GetUserOrders", dbSystem)
+	res, err := r.next.GetUserOrders(ctx, userID)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) UpdateOrderStatus(ctx context.Context, orderNumber, status string, accrual float64) error {
+	ctx, span := tracing.StartChild(ctx, "repository.UpdateOrderStatus", dbSystem)
+	err := r.next.UpdateOrderStatus(ctx, orderNumber, status, accrual)
+	tracing.End(span, err)
+	return err
+}
+
+func (r *tracedRepository) ClaimPendingOrders(ctx context.Context, limit int, lease time.Duration) ([]models.Order, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.ClaimPendingOrders", dbSystem)
+	res, err := r.next.ClaimPendingOrders(ctx, limit, lease)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) ReleaseOrderClaims(ctx context.Context, orderNumbers []string) error {
+	ctx, span := tracing.StartChild(ctx, "repository.ReleaseOrderClaims", dbSystem)
+	err := r.next.ReleaseOrderClaims(ctx, orderNumbers)
+	tracing.End(span, err)
+	return err
+}
+
+func (r *tracedRepository) RequeueOrder(ctx context.Context, orderNumber string) (bool, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.RequeueOrder", dbSystem)
+	res, err := r.next.RequeueOrder(ctx, orderNumber)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) GetOrderStats(ctx context.Context) (*models.OrderStats, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.GetOrderStats", dbSystem)
+	res, err := r.next.GetOrderStats(ctx)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) GetUserBalance(ctx context.Context, userID int64) (*models.Balance, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.GetUserBalance", dbSystem)
+	res, err := r.next.GetUserBalance(ctx, userID)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) GetUserDataVersion(ctx context.Context, userID int64) (int64, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.GetUserDataVersion", dbSystem)
+	res, err := r.next.GetUserDataVersion(ctx, userID)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) WithdrawBalance(ctx context.Context, userID int64, orderNumber string, amount float64) error {
+	ctx, span := tracing.StartChild(ctx, "repository.WithdrawBalance", dbSystem)
+	err := r.next.WithdrawBalance(ctx, userID, orderNumber, amount)
+	tracing.End(span, err)
+	return err
+}
+
+func (r *tracedRepository) GetUserWithdrawals(ctx context.Context, userID int64) ([]models.Withdrawal, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.GetUserWithdrawals", dbSystem)
+	res, err := r.next.GetUserWithdrawals(ctx, userID)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) CreateAPIKey(ctx context.Context, key *models.APIKey) (int64, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.CreateAPIKey", dbSystem)
+	res, err := r.next.CreateAPIKey(ctx, key)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) GetAPIKeyByHash(ctx context.Context, keyHash string) (*models.APIKey, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.GetAPIKeyByHash", dbSystem)
+	res, err := r.next.GetAPIKeyByHash(ctx, keyHash)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) GetUserAPIKeys(ctx context.Context, userID int64) ([]models.APIKey, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.GetUserAPIKeys", dbSystem)
+	res, err := r.next.GetUserAPIKeys(ctx, userID)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) RevokeAPIKey(ctx context.Context, userID, keyID int64) (bool, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.RevokeAPIKey", dbSystem)
+	res, err := r.next.RevokeAPIKey(ctx, userID, keyID)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) CreateAuditEvent(ctx context.Context, event *models.AuditEvent) error {
+	ctx, span := tracing.StartChild(ctx, "repository.CreateAuditEvent", dbSystem)
+	err := r.next.CreateAuditEvent(ctx, event)
+	tracing.End(span, err)
+	return err
+}
+
+func (r *tracedRepository) GetUserAuditEvents(ctx context.Context, userID int64, limit int) ([]models.AuditEvent, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.GetUserAuditEvents", dbSystem)
+	res, err := r.next.GetUserAuditEvents(ctx, userID, limit)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) GetLoginAttempt(ctx context.Context, scope, key string) (*models.LoginAttempt, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.GetLoginAttempt", dbSystem)
+	res, err := r.next.GetLoginAttempt(ctx, scope, key)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) ClaimLoginAttempt(ctx context.Context, scope, key string, windowStart time.Time, delays []time.Duration) (*models.LoginAttempt, bool, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.ClaimLoginAttempt", dbSystem)
+	res, ok, err := r.next.ClaimLoginAttempt(ctx, scope, key, windowStart, delays)
+	tracing.End(span, err)
+	return res, ok, err
+}
+
+func (r *tracedRepository) ReleaseLoginAttempt(ctx context.Context, scope, key string) error {
+	ctx, span := tracing.StartChild(ctx, "repository.ReleaseLoginAttempt", dbSystem)
+	err := r.next.ReleaseLoginAttempt(ctx, scope, key)
+	tracing.End(span, err)
+	return err
+}
+
+func (r *tracedRepository) ResetLoginAttempts(ctx context.Context, scope, key string) error {
+	ctx, span := tracing.StartChild(ctx, "repository.ResetLoginAttempts", dbSystem)
+	err := r.next.ResetLoginAttempts(ctx, scope, key)
+	tracing.End(span, err)
+	return err
+}
+
+func (r *tracedRepository) DeleteStaleLoginAttempts(ctx context.Context, before time.Time) (int64, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.DeleteStaleLoginAttempts", dbSystem)
+	res, err := r.next.DeleteStaleLoginAttempts(ctx, before)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) CreateIdempotencyKey(ctx context.Context, key *models.IdempotencyKey) (bool, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.CreateIdempotencyKey", dbSystem)
+	res, err := r.next.CreateIdempotencyKey(ctx, key)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) GetIdempotencyKey(ctx context.Context, userID int64, key string) (*models.IdempotencyKey, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.GetIdempotencyKey", dbSystem)
+	res, err := r.next.GetIdempotencyKey(ctx, userID, key)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) CompleteIdempotencyKey(ctx context.Context, key *models.IdempotencyKey) error {
+	ctx, span := tracing.StartChild(ctx, "repository.CompleteIdempotencyKey", dbSystem)
+	err := r.next.CompleteIdempotencyKey(ctx, key)
+	tracing.End(span, err)
+	return err
+}
+
+func (r *tracedRepository) DeleteIdempotencyKey(ctx context.Context, userID int64, key string) error {
+	ctx, span := tracing.StartChild(ctx, "repository.DeleteIdempotencyKey", dbSystem)
+	err := r.next.DeleteIdempotencyKey(ctx, userID, key)
+	tracing.End(span, err)
+	return err
+}
+
+func (r *tracedRepository) DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.DeleteExpiredIdempotencyKeys", dbSystem)
+	res, err := r.next.DeleteExpiredIdempotencyKeys(ctx)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) TakeRateLimitToken(ctx context.Context, key string, capacity, rate float64) (*models.TokenBucket, bool, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.TakeRateLimitToken", dbSystem)
+	bucket, allowed, err := r.next.TakeRateLimitToken(ctx, key, capacity, rate)
+	tracing.End(span, err)
+	return bucket, allowed, err
+}
+
+func (r *tracedRepository) DeleteIdleRateLimitBuckets(ctx context.Context, before time.Time) (int64, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.DeleteIdleRateLimitBuckets", dbSystem)
+	res, err := r.next.DeleteIdleRateLimitBuckets(ctx, before)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) GetUserEvents(ctx context.Context, userID, afterID int64, limit int) ([]models.UserEvent, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.GetUserEvents", dbSystem)
+	res, err := r.next.GetUserEvents(ctx, userID, afterID, limit)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) GetLatestUserEventID(ctx context.Context, userID int64) (int64, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.GetLatestUserEventID", dbSystem)
+	res, err := r.next.GetLatestUserEventID(ctx, userID)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (r *tracedRepository) DeleteUserEventsBefore(ctx context.Context, before time.Time) (int64, error) {
+	ctx, span := tracing.StartChild(ctx, "repository.DeleteUserEventsBefore", dbSystem)
+	res, err := r.next.DeleteUserEventsBefore(ctx, before)
+	tracing.End(span, err)
+	return res, err
+}
+
+// ListenUserEvents is not traced: it blocks for the life of the process
+func (r *tracedRepository) ListenUserEvents(ctx context.Context, notify func(userID int64)) error {
+	return r.next.ListenUserEvents(ctx, notify)
+}
+
+// NewAdvisoryLock is not traced: the lock is polled on a timer and the
+// spans would only be noise
+func (r *tracedRepository) NewAdvisoryLock(key int64) AdvisoryLock {
+	return r.next.NewAdvisoryLock(key)
+}
+
+func (r *tracedRepository) InitDB(databaseURI string) error {
+	return r.next.InitDB(databaseURI)
+}
+
+func (r *tracedRepository) Migrate() error {
+	return r.next.Migrate()
+}
+
+func (r *tracedRepository) Ping(ctx context.Context) error {
+	ctx, span := tracing.StartChild(ctx, "repository.Ping", dbSystem)
+	err := r.next.Ping(ctx)
+	tracing.End(span, err)
+	return err
+}
+
+func (r *tracedRepository) Stats() sql.DBStats {
+	return r.next.Stats()
+}
+
+func (r *tracedRepository) Close() error {
+	return r.next.Close()
+}
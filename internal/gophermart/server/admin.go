@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/metrics"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/service"
+	"golang.org/x/exp/slog"
+)
+
+// startTime is reported as process uptime
+var startTime = time.Now()
+
+func init() {
+	// expvar already publishes memstats and cmdline
+	expvar.Publish("goroutines", expvar.Func(func() any {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("uptime_seconds", expvar.Func(func() any {
+		return time.Since(startTime).Seconds()
+	}))
+}
+
+// adminRoutes returns the handler for the admin listener
+func (s *Server) adminRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+
+	// Health checks, for modes without the HTTP API
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+
+	// Profiling
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	// Runtime diagnostics
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/buildinfo", s.buildInfo)
+	mux.HandleFunc("/debug/worker", s.workerState)
+
+	return mux
+}
+
+// buildInfo reports the Go version, module versions and VCS revision the
+// binary was built from
+func (s *Server) buildInfo(w http.ResponseWriter, r *http.Request) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		http.Error(w, "Build info unavailable", http.StatusNotFound)
+		return
+	}
+
+	response := struct {
+		GoVersion string            `json:"go_version"`
+		Path      string            `json:"path"`
+		Version   string            `json:"version"`
+		Settings  map[string]string `json:"settings"`
+		Deps      map[string]string `json:"deps"`
+	}{
+		GoVersion: info.GoVersion,
+		Path:      info.Main.Path,
+		Version:   info.Main.Version,
+		Settings:  make(map[string]string),
+		Deps:      make(map[string]string),
+	}
+	for _, setting := range info.Settings {
+		response.Settings[setting.Key] = setting.Value
+	}
+	for _, dep := range info.Deps {
+		response.Deps[dep.Path] = dep.Version
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// workerState dumps the order processor state together with the number
+// of orders waiting for accrual
+func (s *Server) workerState(w http.ResponseWriter, r *http.Request) {
+	response := struct {
+		QueueDepth *int64 `json:"queue_depth"`
+		Leader     bool   `json:"leader"`
+		service.WorkerState
+	}{
+		Leader:      s.app.Leader.IsLeader(),
+		WorkerState: s.orderProcessor.State(),
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessPingTimeout)
+	defer cancel()
+	if stats, err := s.repo.GetOrderStats(ctx); err == nil {
+		depth := stats.CountByStatus[models.StatusNew] + stats.CountByStatus[models.StatusProcessing]
+		response.QueueDepth = &depth
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// startAdmin starts the admin listener if it is configured. It listens
+// before returning so that a bad address fails startup.
+func (s *Server) startAdmin() error {
+	if s.cfg.AdminAddress == "" {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", s.cfg.AdminAddress)
+	if err != nil {
+		return err
+	}
+
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+		slog.Warn("Admin listener is not bound to localhost and exposes profiling data", "address", ln.Addr().String())
+	}
+
+	s.adminServer = &http.Server{Handler: s.adminRoutes()}
+	go func() {
+		slog.Info("Starting admin server", "address", ln.Addr().String())
+		if err := s.adminServer.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Admin server error", "error", err)
+		}
+	}()
+
+	return nil
+}
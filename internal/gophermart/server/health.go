@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/service"
+)
+
+// readinessPingTimeout bounds the database check so that a hung
+// connection doesn't hang the probe
+const readinessPingTimeout = 2 * time.Second
+
+// Check statuses
+const (
+	checkOK       = "ok"
+	checkFailing  = "failing"
+	checkDegraded = "degraded"
+)
+
+// checkResult is the outcome of a single readiness check
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// accrualCheck reports the accrual client state
+type accrualCheck struct {
+	Status string `json:"status"`
+	service.AccrualState
+}
+
+// workerCheck reports when the order processor last polled successfully
+type workerCheck struct {
+	Status   string     `json:"status"`
+	LastTick *time.Time `json:"last_tick,omitempty"`
+	Leader   bool       `json:"leader"`
+}
+
+// readiness is the /readyz response body
+type readiness struct {
+	Status       string       `json:"status"`
+	ShuttingDown bool         `json:"shutting_down"`
+	Database     checkResult  `json:"database"`
+	Accrual      accrualCheck `json:"accrual"`
+	Worker       *workerCheck `json:"worker,omitempty"`
+}
+
+// healthz reports that the process is alive and serving requests
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(checkResult{Status: checkOK})
+}
+
+// readyz reports whether the server should receive traffic. Only the
+// database and shutdown state make it fail; the accrual system and the
+// worker affect order processing, not the API, and are reported as
+// degraded. The worker is only checked when this process runs it.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	resp := readiness{
+		Status:       checkOK,
+		ShuttingDown: !s.ready.Load(),
+		Database:     checkResult{Status: checkOK},
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessPingTimeout)
+	defer cancel()
+	if err := s.repo.Ping(ctx); err != nil {
+		// The probe is served on the public listener, so the driver error,
+		// which may name hosts and users, is only logged
+		logging.FromContext(ctx).Error("Readiness check: database ping failed", "error", err)
+		resp.Database = checkResult{Status: checkFailing, Error: "database unavailable"}
+	}
+
+	resp.Accrual = accrualCheck{Status: checkOK, AccrualState: s.accrualSvc.State()}
+	if resp.Accrual.Circuit != service.CircuitClosed || resp.Accrual.RateLimitedUntil != nil {
+		resp.Accrual.Status = checkDegraded
+	}
+
+	// The worker is stale if it has missed several ticks
+	if s.mode.Worker {
+		resp.Worker = &workerCheck{Status: checkOK, Leader: s.app.Leader.IsLeader()}
+		if lastTick := s.orderProcessor.LastTick(); lastTick.IsZero() {
+			resp.Worker.Status = checkDegraded
+		} else {
+			resp.Worker.LastTick = &lastTick
+			if time.Since(lastTick) > 3*s.orderProcessor.Interval() {
+				resp.Worker.Status = checkDegraded
+			}
+		}
+	}
+
+	status := http.StatusOK
+	if resp.ShuttingDown || resp.Database.Status != checkOK {
+		resp.Status = checkFailing
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
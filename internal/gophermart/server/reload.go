@@ -0,0 +1,79 @@
+package server
+
+import (
+	"golang.org/x/exp/slog"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/app"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/config"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
+)
+
+// Reload applies the settings that can change without a restart: the log
+// level, the worker interval and concurrency, the accrual timeout, the
+// idempotency key TTL, the rate limits and the JWT keys.
+// The new configuration has already been validated as a whole, so either
+// every safe change is applied or, if loading failed, none is. Changes to
+// any other setting are logged and take effect on the next restart.
+func (s *Server) Reload(cfg *config.Config) {
+	next := *s.cfg
+	keysChanged := false
+	limitsChanged := false
+
+	for _, key := range s.cfg.Diff(cfg) {
+		switch key {
+		case "log_level":
+			if err := logging.SetLevel(cfg.LogLevel); err != nil {
+				slog.Error("Config reload: invalid log level", "error", err)
+				continue
+			}
+			next.LogLevel = cfg.LogLevel
+		case "accrual_poll_interval":
+			next.AccrualPollInterval = cfg.AccrualPollInterval
+			s.orderProcessor.SetInterval(cfg.AccrualPollInterval)
+		case "worker_concurrency":
+			next.WorkerConcurrency = cfg.WorkerConcurrency
+			s.orderProcessor.SetConcurrency(cfg.WorkerConcurrency)
+		case "accrual_timeout":
+			next.AccrualTimeout = cfg.AccrualTimeout
+			s.accrualSvc.SetTimeout(cfg.AccrualTimeout)
+		case "idempotency_key_ttl":
+			next.IdempotencyKeyTTL = cfg.IdempotencyKeyTTL
+			s.app.Idempotency.SetTTL(cfg.IdempotencyKeyTTL)
+		case "rate_limit_auth":
+			next.RateLimitAuth = cfg.RateLimitAuth
+			limitsChanged = true
+		case "rate_limit_api":
+			next.RateLimitAPI = cfg.RateLimitAPI
+			limitsChanged = true
+		case "rate_limit_orders":
+			next.RateLimitOrders = cfg.RateLimitOrders
+			limitsChanged = true
+		case "jwt_secret":
+			next.JWTSecret = cfg.JWTSecret
+			keysChanged = true
+		case "jwt_previous_secrets":
+			next.JWTPreviousSecrets = cfg.JWTPreviousSecrets
+			keysChanged = true
+		default:
+			slog.Warn("Config reload: setting changed, restart required to apply", "setting", key)
+			continue
+		}
+		slog.Info("Config reload: setting applied", "setting", key)
+	}
+
+	if limitsChanged {
+		s.app.RateLimiter.SetLimits(app.RateLimits(&next))
+	}
+
+	// The worker mode has no JWT keys to replace
+	if keysChanged && s.jwtConfig != nil {
+		secret := next.JWTSecret
+		if secret == "" {
+			// Keep signing with the random key generated at startup
+			secret = s.jwtConfig.SecretKey
+		}
+		s.jwtConfig.SetKeys(secret, next.JWTPreviousSecrets)
+	}
+
+	s.cfg = &next
+}
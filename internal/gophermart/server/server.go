@@ -2,117 +2,390 @@ package server
 
 import (
 	"context"
-	"log"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/app"
 	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/config"
 	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/handlers"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/metrics"
 	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/middleware"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
 	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
 	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/service"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/tracing"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/utils"
 	"github.com/go-chi/chi/v5"
 	chiMiddleware "github.com/go-chi/chi/v5/middleware"
+	"golang.org/x/exp/slog"
 )
 
+// Mode selects what a Server runs: the HTTP API, the order processor or
+// both. The admin listener runs in every mode.
+type Mode struct {
+	API    bool
+	Worker bool
+}
+
 // Server represents the HTTP server
 type Server struct {
+	app            *app.App
+	mode           Mode
 	cfg            *config.Config
 	repo           repository.Repository
 	accrualSvc     *service.AccrualService
+	jwtConfig      *middleware.JWTConfig
 	orderProcessor *service.OrderProcessor
 	handler        *handlers.Handler
 	httpServer     *http.Server
+	adminServer    *http.Server
+	redirectServer *http.Server
+
+	// ready is cleared at the start of shutdown to fail readiness checks
+	ready atomic.Bool
+	// done is closed by Shutdown; a worker-only Run waits on it
+	done     chan struct{}
+	doneOnce sync.Once
 }
 
-// NewServer creates a new server
-func NewServer(cfg *config.Config) *Server {
-	repo := repository.NewPostgresRepository(cfg.DatabaseURI)
-	accrualSvc := service.NewAccrualService(cfg.AccrualSystemAddress)
-	orderProcessor := service.NewOrderProcessor(repo, accrualSvc)
-	handler := handlers.NewHandler(repo, accrualSvc, "your-secret-key") // In real app, use a secure random key
+// NewServer creates a new server running the parts of the application
+// selected by mode
+func NewServer(a *app.App, mode Mode) (*Server, error) {
+	s := &Server{
+		app:            a,
+		mode:           mode,
+		cfg:            a.Config,
+		repo:           a.Repo,
+		accrualSvc:     a.AccrualSvc,
+		orderProcessor: a.OrderProcessor,
+		done:           make(chan struct{}),
+	}
+	if !mode.API {
+		return s, nil
+	}
+
+	cfg := a.Config
+	repo := a.Repo
+	loginGuard := a.LoginGuard
+	passwordPolicy, err := service.NewPasswordPolicy(cfg.PasswordMinLength, cfg.RejectedPasswordsFile)
+	if err != nil {
+		return nil, err
+	}
+	hasher := service.NewArgon2idHasher(service.DefaultArgon2idParams())
+	twoFactor := service.NewTwoFactorService(repo, cfg.TOTPIssuer)
+	apiKeys := service.NewAPIKeyService(repo)
+
+	secret := cfg.JWTSecret
+	if secret == "" {
+		secret, err = randomSecret()
+		if err != nil {
+			return nil, err
+		}
+		slog.Warn("JWT secret is not configured, using a random one: tokens won't survive a restart or work across replicas")
+	}
+	jwtConfig := &middleware.JWTConfig{
+		SecretKey:    secret,
+		PreviousKeys: cfg.JWTPreviousSecrets,
+		TokenTTL:     cfg.JWTLifetime,
+		Repo:         repo,
+		APIKeys:      apiKeys,
+	}
+
+	var oidc *service.OIDCService
+	if cfg.OIDCIssuer != "" {
+		oidc = service.NewOIDCService(repo, service.OIDCConfig{
+			Issuer:       cfg.OIDCIssuer,
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			RedirectURL:  cfg.OIDCRedirectURL,
+		}, secret)
+	}
 
-	return &Server{
-		cfg:            cfg,
-		repo:           repo,
-		accrualSvc:     accrualSvc,
-		orderProcessor: orderProcessor,
-		handler:        handler,
+	sameSite, err := middleware.ParseSameSite(cfg.CookieSameSite)
+	if err != nil {
+		return nil, err
+	}
+	cookies := middleware.CookieConfig{
+		Secure:   cfg.CookieSecure,
+		SameSite: sameSite,
+		Domain:   cfg.CookieDomain,
+		MaxAge:   cfg.JWTLifetime,
 	}
+
+	audit := service.NewAuditService(repo)
+	handler := handlers.NewHandler(
+		repo,
+		loginGuard,
+		hasher,
+		passwordPolicy,
+		twoFactor,
+		apiKeys,
+		oidc,
+		jwtConfig,
+		cookies,
+		audit,
+		a.Events,
+		a.RateLimiter,
+		cfg.WithdrawTOTPThreshold,
+		cfg.RequestTimeout,
+	)
+
+	s.jwtConfig = jwtConfig
+	s.handler = handler
+	return s, nil
 }
 
-// Run starts the HTTP server
+// randomSecret generates a signing secret for when none is configured
+func randomSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Run starts the server and blocks until it is shut down, returning
+// http.ErrServerClosed after a graceful shutdown
 func (s *Server) Run() error {
 	// Initialize repository
-	if err := s.repo.InitDB(s.cfg.DatabaseURI); err != nil {
+	if err := s.app.Open(); err != nil {
 		return err
 	}
 
-	// Start order processor
-	s.orderProcessor.Start()
+	var tlsConfig *tls.Config
+	if s.mode.API {
+		var err error
+		if tlsConfig, err = s.tlsConfig(); err != nil {
+			return err
+		}
+	}
 
-	// Create router
+	if err := metrics.RegisterStore(s.repo); err != nil {
+		return err
+	}
+	if err := s.startAdmin(); err != nil {
+		return err
+	}
+
+	// Start order processor and campaign for the singleton jobs
+	if s.mode.Worker {
+		s.orderProcessor.Start()
+		s.app.Leader.Start()
+	}
+
+	// Listen for user events to stream to clients
+	if s.mode.API {
+		s.app.Events.Start()
+	}
+
+	if !s.mode.API {
+		s.ready.Store(true)
+		slog.Info("Running order processor without the HTTP API")
+		<-s.done
+		return http.ErrServerClosed
+	}
+
+	// Create HTTP server
+	s.httpServer = &http.Server{
+		Addr:      s.cfg.RunAddress,
+		Handler:   s.routes(),
+		TLSConfig: tlsConfig,
+	}
+
+	// Start server
+	if tlsConfig == nil {
+		s.ready.Store(true)
+		slog.Info("Starting server", "address", s.cfg.RunAddress)
+		return s.httpServer.ListenAndServe()
+	}
+
+	if err := s.startRedirect(); err != nil {
+		return err
+	}
+	s.ready.Store(true)
+	slog.Info("Starting server with TLS", "address", s.cfg.RunAddress, "mtls", s.cfg.TLSClientCAFile != "")
+	// The certificate comes from TLSConfig.GetCertificate
+	return s.httpServer.ListenAndServeTLS("", "")
+}
+
+// routes builds the HTTP API router
+func (s *Server) routes() http.Handler {
 	r := chi.NewRouter()
 
 	// Basic middleware
 	r.Use(chiMiddleware.RequestID)
-	r.Use(chiMiddleware.RealIP)
-	r.Use(chiMiddleware.Logger)
+	// Validated with the rest of the configuration
+	trustedProxies, _ := config.ParseTrustedProxies(s.cfg.TrustedProxies)
+	r.Use(middleware.RealIP(trustedProxies))
+	r.Use(metrics.Middleware)
+	r.Use(tracing.Middleware)
+	r.Use(logging.Middleware)
 	r.Use(chiMiddleware.Recoverer)
-	r.Use(chiMiddleware.Timeout(60 * time.Second))
+	r.Use(middleware.Compress(s.cfg.CompressMinSize))
+	r.Use(middleware.Decompress(s.cfg.MaxDecompressedSize))
+
+	// Streams are long-lived, so the timeout is applied per route group
+	timeout := chiMiddleware.Timeout(s.cfg.RequestTimeout)
+
+	// Health checks
+	r.Get("/healthz", s.healthz)
+	r.Get("/readyz", s.readyz)
+
+	limiter := s.app.RateLimiter
 
 	// Public routes
 	r.Route("/api/user", func(r chi.Router) {
-		r.Post("/register", s.handler.RegisterUser)
-		r.Post("/login", s.handler.LoginUser)
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.RateLimitByIP(limiter, middleware.RateLimitGroupAuth))
+			r.Use(timeout)
+
+			r.Post("/register", s.handler.RegisterUser)
+			r.Post("/login", s.handler.LoginUser)
+
+			// Single sign-on routes
+			if s.handler.OIDC != nil {
+				r.Get("/oidc/login", s.handler.OIDCLogin)
+				r.Get("/oidc/callback", s.handler.OIDCCallback)
+				r.Post("/oidc/2fa", s.handler.OIDCTwoFactor)
+			}
+		})
 
 		// Protected routes
 		r.Group(func(r chi.Router) {
-			jwtConfig := &middleware.JWTConfig{
-				SecretKey: "your-secret-key", // In real app, use a secure random key
-				Repo:      s.repo,
-			}
-			r.Use(middleware.AuthMiddleware(jwtConfig))
+			r.Use(middleware.AuthMiddleware(s.jwtConfig))
+			r.Use(middleware.RateLimitByUser(limiter, middleware.RateLimitGroupAPI))
+			r.Use(middleware.CSRFMiddleware)
+
+			// Event stream and WebSocket API
+			r.Group(func(r chi.Router) {
+				r.Use(middleware.RequireScope(models.ScopeOrdersRead), middleware.RequireScope(models.ScopeBalanceRead))
 
-			r.Post("/orders", s.handler.UploadOrder)
-			r.Get("/orders", s.handler.GetOrders)
-			r.Get("/balance", s.handler.GetBalance)
-			r.Post("/balance/withdraw", s.handler.WithdrawBalance)
-			r.Get("/withdrawals", s.handler.GetWithdrawals)
+				r.Get("/events", s.handler.StreamEvents)
+				r.Get("/ws", s.handler.ServeWebSocket)
+			})
+
+			r.Group(func(r chi.Router) {
+				r.Use(timeout)
+
+				r.With(
+					middleware.RequireScope(models.ScopeOrdersWrite),
+					middleware.RateLimitByUser(limiter, middleware.RateLimitGroupOrders),
+					middleware.Idempotency(s.app.Idempotency),
+				).Post("/orders", s.handler.UploadOrder)
+				r.With(middleware.RequireScope(models.ScopeOrdersRead)).Get("/orders", s.handler.GetOrders)
+				r.With(middleware.RequireScope(models.ScopeOrdersRead)).Get("/orders/{number}", s.handler.GetOrder)
+				r.With(middleware.RequireScope(models.ScopeBalanceRead)).Get("/balance", s.handler.GetBalance)
+				r.With(middleware.RequireScope(models.ScopeBalanceWithdraw), middleware.Idempotency(s.app.Idempotency)).Post("/balance/withdraw", s.handler.WithdrawBalance)
+				r.With(middleware.RequireScope(models.ScopeBalanceRead)).Get("/withdrawals", s.handler.GetWithdrawals)
+
+				// Account management is not available to API keys
+				r.Group(func(r chi.Router) {
+					r.Use(middleware.RequireSession)
+
+					r.Post("/token/refresh", s.handler.RefreshToken)
+
+					r.Post("/2fa/enroll", s.handler.EnrollTwoFactor)
+					r.Post("/2fa/confirm", s.handler.ConfirmTwoFactor)
+					r.Post("/2fa/disable", s.handler.DisableTwoFactor)
+
+					r.Post("/api-keys", s.handler.CreateAPIKey)
+					r.Get("/api-keys", s.handler.ListAPIKeys)
+					r.Delete("/api-keys/{id}", s.handler.RevokeAPIKey)
+
+					r.Get("/security-events", s.handler.GetSecurityEvents)
+				})
+			})
 		})
 	})
 
-	// Create HTTP server
-	s.httpServer = &http.Server{
-		Addr:    s.cfg.RunAddress,
-		Handler: r,
-	}
+	// Admin routes
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Use(middleware.AuthMiddleware(s.jwtConfig))
+		// Audited before any check so that denied attempts are recorded too
+		r.Use(middleware.AdminAudit(s.handler.Audit))
+		r.Use(middleware.RateLimitByUser(limiter, middleware.RateLimitGroupAPI))
+		r.Use(timeout)
+		r.Use(middleware.CSRFMiddleware)
+		r.Use(middleware.RequireSession)
+		r.Use(middleware.RequireRole(models.RoleSupport, models.RoleAdmin))
 
-	// Start server
-	log.Printf("Starting server on %s", s.cfg.RunAddress)
-	return s.httpServer.ListenAndServe()
+		r.Get("/users", s.handler.AdminSearchUsers)
+		r.Get("/users/{id}", s.handler.AdminGetUser)
+		r.Get("/users/{id}/orders", s.handler.AdminGetUserOrders)
+		r.Get("/users/{id}/withdrawals", s.handler.AdminGetUserWithdrawals)
+		r.Get("/users/{id}/balance", s.handler.AdminGetUserBalance)
+		r.Post("/orders/{number}/requeue", s.handler.AdminRequeueOrder)
+
+		// Account changes are restricted to admins
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.RequireRole(models.RoleAdmin))
+
+			r.Post("/users/{id}/disable", s.handler.AdminDisableUser)
+			r.Put("/users/{id}/role", s.handler.AdminSetUserRole)
+		})
+	})
+
+	return r
 }
 
-// Shutdown gracefully shuts down the server
+// Shutdown gracefully shuts down the server in any mode
 func (s *Server) Shutdown(ctx context.Context) error {
-	// Shutdown HTTP server
+	// Fail readiness first and give load balancers time to notice
+	s.ready.Store(false)
+	if delay := s.cfg.ShutdownDrainDelay; delay > 0 && s.mode.API {
+		slog.Info("Waiting before draining connections", "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+
+	s.doneOnce.Do(func() { close(s.done) })
+
+	// End event streams so that the HTTP server can drain
+	if s.mode.API {
+		s.app.Events.Stop()
+	}
+
+	// Every step is attempted even if an earlier one fails, so that a
+	// stuck server doesn't keep the worker running or the database open
+	var errs []error
+
+	// Shutdown HTTP servers
+	if s.redirectServer != nil {
+		if err := s.redirectServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("shutdown redirect server: %w", err))
+		}
+	}
 	if s.httpServer != nil {
 		if err := s.httpServer.Shutdown(ctx); err != nil {
-			return err
+			errs = append(errs, fmt.Errorf("shutdown HTTP server: %w", err))
 		}
 	}
 
-	// Stop order processor
-	if s.orderProcessor != nil {
-		s.orderProcessor.Stop()
+	// Metrics stay available until the main server has drained
+	if s.adminServer != nil {
+		if err := s.adminServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("shutdown admin server: %w", err))
+		}
 	}
 
-	// Close repository
-	if s.repo != nil {
-		if err := s.repo.Close(); err != nil {
-			return err
+	// Stop order processor and hand leadership over to another replica
+	if s.mode.Worker {
+		s.orderProcessor.Stop()
+		if err := s.app.Leader.Stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("release leadership: %w", err))
 		}
 	}
 
-	return nil
+	// Close repository and flush remaining spans
+	errs = append(errs, s.app.Close(ctx))
+	return utils.JoinErrors(errs...)
 }
@@ -3,57 +3,243 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/metrics"
 	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
 )
 
+// Accrual errors returned without contacting the accrual system
+var (
+	ErrAccrualRateLimited = errors.New("accrual system rate limit in effect")
+	ErrAccrualCircuitOpen = errors.New("accrual system circuit is open")
+)
+
+// Circuit breaker settings
+const (
+	// circuitFailureThreshold consecutive failures open the circuit
+	circuitFailureThreshold = 5
+	// circuitOpenDuration is how long requests are refused before a trial
+	// request is let through
+	circuitOpenDuration = 30 * time.Second
+	// defaultRetryAfter is used when a 429 response has no usable
+	// Retry-After header
+	defaultRetryAfter = 60 * time.Second
+)
+
+// Circuit states
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// AccrualState describes the health of the accrual client
+type AccrualState struct {
+	Circuit             string     `json:"circuit"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenUntil           *time.Time `json:"open_until,omitempty"`
+	RateLimitedUntil    *time.Time `json:"rate_limited_until,omitempty"`
+}
+
 // AccrualService handles communication with the accrual service
 type AccrualService struct {
 	baseURL    string
 	httpClient *http.Client
+	// timeout is applied per request so that it can be changed at runtime
+	timeout atomic.Int64
+
+	mu               sync.Mutex
+	failures         int
+	openUntil        time.Time
+	rateLimitedUntil time.Time
+	// probing is set while the trial request of a half-open circuit is in
+	// flight; other requests are refused until it completes
+	probing bool
 }
 
 // NewAccrualService creates a new accrual service
-func NewAccrualService(baseURL string) *AccrualService {
-	return &AccrualService{
+func NewAccrualService(baseURL string, timeout time.Duration) *AccrualService {
+	s := &AccrualService{
 		baseURL: baseURL,
-		httpClient: &http.Client{
-			Timeout: 10 * time.Second,
-		},
+		// The transport propagates the trace context to the accrual system
+		httpClient: &http.Client{Transport: tracing.Transport(http.DefaultTransport)},
 	}
+	s.SetTimeout(timeout)
+	return s
+}
+
+// SetTimeout changes the timeout of subsequent requests
+func (s *AccrualService) SetTimeout(timeout time.Duration) {
+	s.timeout.Store(int64(timeout))
+}
+
+// Timeout returns the timeout of a request
+func (s *AccrualService) Timeout() time.Duration {
+	return time.Duration(s.timeout.Load())
+}
+
+// State returns the current circuit and rate limit state
+func (s *AccrualService) State() AccrualState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	state := AccrualState{
+		Circuit:             CircuitClosed,
+		ConsecutiveFailures: s.failures,
+	}
+	if s.failures >= circuitFailureThreshold {
+		state.Circuit = CircuitHalfOpen
+		if now.Before(s.openUntil) {
+			state.Circuit = CircuitOpen
+			openUntil := s.openUntil
+			state.OpenUntil = &openUntil
+		}
+	}
+	if now.Before(s.rateLimitedUntil) {
+		until := s.rateLimitedUntil
+		state.RateLimitedUntil = &until
+	}
+
+	return state
+}
+
+// allow reports whether a request may be sent now. Once the circuit is
+// half-open, a single trial request is let through; the returned flag is
+// set for it, and the caller must end it with endProbe.
+func (s *AccrualService) allow() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(s.rateLimitedUntil) {
+		return false, ErrAccrualRateLimited
+	}
+	if s.failures < circuitFailureThreshold {
+		return false, nil
+	}
+	if now.Before(s.openUntil) || s.probing {
+		return false, ErrAccrualCircuitOpen
+	}
+	s.probing = true
+	return true, nil
+}
+
+// endProbe lets the next trial request through if the circuit is still
+// half-open, e.g. because the trial was cancelled before it got an answer
+func (s *AccrualService) endProbe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.probing = false
+}
+
+// recordResult updates the circuit breaker after a request
+func (s *AccrualService) recordResult(ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ok {
+		if s.failures >= circuitFailureThreshold {
+			slog.Info("Accrual system circuit closed")
+		}
+		s.failures = 0
+		return
+	}
+
+	s.failures++
+	if s.failures >= circuitFailureThreshold {
+		// Also re-opens a half-open circuit whose trial request failed
+		s.openUntil = time.Now().Add(circuitOpenDuration)
+		if s.failures == circuitFailureThreshold {
+			slog.Warn("Accrual system circuit opened", "consecutive_failures", s.failures)
+		}
+	}
+}
+
+// rateLimit stops requests until the accrual system allows them again
+func (s *AccrualService) rateLimit(retryAfter time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rateLimitedUntil = time.Now().Add(retryAfter)
+	slog.Warn("Accrual system rate limit hit, pausing requests", "retry_after", retryAfter)
 }
 
 // GetOrderAccrual fetches the accrual information for an order
 func (s *AccrualService) GetOrderAccrual(ctx context.Context, orderNumber string) (*models.AccrualResponse, error) {
+	ctx, span := tracing.Start(ctx, "accrual.GetOrderAccrual",
+		trace.WithAttributes(attribute.String("order.number", orderNumber)))
+	resp, err := s.getOrderAccrual(ctx, orderNumber)
+	tracing.End(span, err)
+	return resp, err
+}
+
+func (s *AccrualService) getOrderAccrual(ctx context.Context, orderNumber string) (*models.AccrualResponse, error) {
+	probe, err := s.allow()
+	if err != nil {
+		return nil, err
+	}
+	if probe {
+		defer s.endProbe()
+	}
+
 	url := fmt.Sprintf("%s/api/orders/%s", s.baseURL, orderNumber)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	reqCtx, cancel := context.WithTimeout(ctx, s.Timeout())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
+		// The caller giving up says nothing about the accrual system; only
+		// our own timeout and transport errors count as failures
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			metrics.ObserveAccrualRequest(metrics.AccrualTimeout)
+		} else {
+			metrics.ObserveAccrualRequest(metrics.AccrualError)
+		}
+		s.recordResult(false)
 		return nil, err
 	}
 	defer resp.Body.Close()
+	metrics.ObserveAccrualRequest(accrualOutcome(resp.StatusCode))
 
 	// Handle rate limiting
 	if resp.StatusCode == http.StatusTooManyRequests {
-		retryAfter := resp.Header.Get("Retry-After")
-		if retryAfter != "" {
-			seconds, err := strconv.Atoi(retryAfter)
-			if err == nil {
-				return nil, fmt.Errorf("rate limited, retry after %d seconds", seconds)
-			}
+		retryAfter := defaultRetryAfter
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
 		}
-		return nil, fmt.Errorf("rate limited")
+		s.rateLimit(retryAfter)
+		return nil, fmt.Errorf("rate limited, retry after %s", retryAfter)
+	}
+
+	// Server errors count towards opening the circuit
+	if resp.StatusCode >= http.StatusInternalServerError {
+		s.recordResult(false)
+		return nil, fmt.Errorf("accrual service returned status %d", resp.StatusCode)
 	}
+	s.recordResult(true)
 
 	// Handle 204 No Content (order not registered)
 	if resp.StatusCode == http.StatusNoContent {
@@ -79,6 +265,22 @@ func (s *AccrualService) GetOrderAccrual(ctx context.Context, orderNumber string
 	return &accrualResp, nil
 }
 
+// accrualOutcome maps a response status to a metrics outcome label
+func accrualOutcome(status int) string {
+	switch {
+	case status == http.StatusOK:
+		return metrics.AccrualOK
+	case status == http.StatusNoContent:
+		return metrics.AccrualNoContent
+	case status == http.StatusTooManyRequests:
+		return metrics.AccrualRateLimited
+	case status >= http.StatusInternalServerError:
+		return metrics.AccrualServerError
+	default:
+		return metrics.AccrualOther
+	}
+}
+
 // ProcessOrderAccrual processes an order through the accrual system
 // and updates its status and accrual in the database
 func (s *AccrualService) ProcessOrderAccrual(ctx context.Context, orderNumber string) error {
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
+)
+
+// API key errors
+var (
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	ErrUnknownScope  = errors.New("unknown scope")
+	ErrNoScopes      = errors.New("at least one scope is required")
+)
+
+// apiKeyPrefix marks keys issued by this service
+const apiKeyPrefix = "gm_"
+
+// APIKeyService issues and authenticates API keys
+type APIKeyService struct {
+	repo repository.Repository
+}
+
+// NewAPIKeyService creates a new API key service
+func NewAPIKeyService(repo repository.Repository) *APIKeyService {
+	return &APIKeyService{repo: repo}
+}
+
+// Create issues a new API key for the user. The plaintext key is returned
+// only once; the repository stores its hash.
+func (s *APIKeyService) Create(ctx context.Context, userID int64, name string, scopes []string, expiresAt *time.Time) (string, *models.APIKey, error) {
+	if len(scopes) == 0 {
+		return "", nil, ErrNoScopes
+	}
+	for _, scope := range scopes {
+		if !isKnownScope(scope) {
+			return "", nil, ErrUnknownScope
+		}
+	}
+
+	prefix, err := randomHex(4)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return "", nil, err
+	}
+	plaintext := apiKeyPrefix + prefix + "_" + secret
+
+	key := &models.APIKey{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    apiKeyPrefix + prefix,
+		KeyHash:   hashAPIKey(plaintext),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+	if _, err := s.repo.CreateAPIKey(ctx, key); err != nil {
+		return "", nil, err
+	}
+
+	return plaintext, key, nil
+}
+
+// Authenticate returns the key matching the plaintext if it is active
+func (s *APIKeyService) Authenticate(ctx context.Context, plaintext string) (*models.APIKey, error) {
+	if !strings.HasPrefix(plaintext, apiKeyPrefix) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	key, err := s.repo.GetAPIKeyByHash(ctx, hashAPIKey(plaintext))
+	if err != nil {
+		return nil, err
+	}
+
+	if key == nil || key.RevokedAt != nil || (key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt)) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	return key, nil
+}
+
+// Active reports whether the user's key with the ID exists and is neither
+// revoked nor expired
+func (s *APIKeyService) Active(ctx context.Context, userID, keyID int64) (bool, error) {
+	keys, err := s.repo.GetUserAPIKeys(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		if key.ID == keyID {
+			return key.RevokedAt == nil && (key.ExpiresAt == nil || time.Now().Before(*key.ExpiresAt)), nil
+		}
+	}
+	return false, nil
+}
+
+// List returns all API keys of the user
+func (s *APIKeyService) List(ctx context.Context, userID int64) ([]models.APIKey, error) {
+	return s.repo.GetUserAPIKeys(ctx, userID)
+}
+
+// Revoke revokes the user's API key. It returns false if no active key matched.
+func (s *APIKeyService) Revoke(ctx context.Context, userID, keyID int64) (bool, error) {
+	return s.repo.RevokeAPIKey(ctx, userID, keyID)
+}
+
+func isKnownScope(scope string) bool {
+	for _, s := range models.AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// hashAPIKey hashes an API key for storage. Keys are long random strings,
+// so a fast hash is enough.
+func hashAPIKey(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,32 @@
+package service
+
+import (
+	"context"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
+)
+
+// AuditService records security events to the append-only audit log
+type AuditService struct {
+	repo repository.Repository
+}
+
+// NewAuditService creates a new audit service
+func NewAuditService(repo repository.Repository) *AuditService {
+	return &AuditService{repo: repo}
+}
+
+// Record stores the event. Failures are logged rather than returned so that
+// auditing never breaks the action being audited.
+func (s *AuditService) Record(ctx context.Context, event models.AuditEvent) {
+	if err := s.repo.CreateAuditEvent(ctx, &event); err != nil {
+		logging.FromContext(ctx).Error("Error recording audit event", "event", event.Type, "user_id", event.UserID, "error", err)
+	}
+}
+
+// List returns the latest events of the user
+func (s *AuditService) List(ctx context.Context, userID int64, limit int) ([]models.AuditEvent, error) {
+	return s.repo.GetUserAuditEvents(ctx, userID, limit)
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// userEventRetention is how long events are kept for clients resuming
+	// a stream
+	userEventRetention = 24 * time.Hour
+	// Delays before listening again after the connection failed
+	listenMinBackoff = time.Second
+	listenMaxBackoff = 30 * time.Second
+)
+
+// EventBroker wakes up the subscribers of a user when events are added for
+// them. Events are written by whichever replica changed the data and
+// announced with Postgres NOTIFY, so every replica learns about them.
+// Subscribers read the events themselves from the repository, which is
+// what makes resuming after a given event possible.
+type EventBroker struct {
+	repo repository.Repository
+
+	mu     sync.Mutex
+	subs   map[int64]map[*EventSubscription]struct{}
+	closed bool
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// EventSubscription receives a signal on C when the user may have new
+// events. Signals are coalesced. C is closed when the broker stops.
+type EventSubscription struct {
+	C chan struct{}
+
+	broker *EventBroker
+	userID int64
+}
+
+// NewEventBroker creates a new event broker
+func NewEventBroker(repo repository.Repository) *EventBroker {
+	return &EventBroker{
+		repo: repo,
+		subs: make(map[int64]map[*EventSubscription]struct{}),
+	}
+}
+
+// Start starts listening for events
+func (b *EventBroker) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.listen(ctx)
+	}()
+}
+
+// Stop stops listening and closes every subscription, which ends the
+// streams using them
+func (b *EventBroker) Stop() {
+	if b.cancel != nil {
+		b.cancel()
+	}
+	b.wg.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, subs := range b.subs {
+		for sub := range subs {
+			close(sub.C)
+		}
+	}
+	b.subs = make(map[int64]map[*EventSubscription]struct{})
+}
+
+// listen keeps a LISTEN connection open until ctx is cancelled
+func (b *EventBroker) listen(ctx context.Context) {
+	backoff := listenMinBackoff
+	for {
+		started := time.Now()
+		err := b.repo.ListenUserEvents(ctx, b.notify)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Error("Error listening for user events", "error", err)
+
+		// Notifications may have been missed while not listening
+		b.notifyAll()
+
+		if time.Since(started) > listenMaxBackoff {
+			backoff = listenMinBackoff
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > listenMaxBackoff {
+			backoff = listenMaxBackoff
+		}
+	}
+}
+
+// Subscribe subscribes to the events of the user. The subscription must be
+// closed when no longer needed.
+func (b *EventBroker) Subscribe(userID int64) *EventSubscription {
+	sub := &EventSubscription{
+		C:      make(chan struct{}, 1),
+		broker: b,
+		userID: userID,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(sub.C)
+		return sub
+	}
+	if b.subs[userID] == nil {
+		b.subs[userID] = make(map[*EventSubscription]struct{})
+	}
+	b.subs[userID][sub] = struct{}{}
+	return sub
+}
+
+// Close cancels the subscription
+func (s *EventSubscription) Close() {
+	b := s.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[s.userID][s]; !ok {
+		return
+	}
+	delete(b.subs[s.userID], s)
+	if len(b.subs[s.userID]) == 0 {
+		delete(b.subs, s.userID)
+	}
+}
+
+// notify wakes up the subscribers of the user
+func (b *EventBroker) notify(userID int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subs[userID] {
+		sub.signal()
+	}
+}
+
+// notifyAll wakes up every subscriber
+func (b *EventBroker) notifyAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, subs := range b.subs {
+		for sub := range subs {
+			sub.signal()
+		}
+	}
+}
+
+// signal sends a signal unless one is already pending. The caller holds
+// the broker's mu.
+func (s *EventSubscription) signal() {
+	select {
+	case s.C <- struct{}{}:
+	default:
+	}
+}
+
+// Prune deletes events older than the retention period
+func (b *EventBroker) Prune(ctx context.Context) error {
+	deleted, err := b.repo.DeleteUserEventsBefore(ctx, time.Now().Add(-userEventRetention))
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		logging.FromContext(ctx).Debug("Pruned old user events", "count", deleted)
+	}
+	return nil
+}
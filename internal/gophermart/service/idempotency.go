@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
+)
+
+var (
+	// ErrIdempotencyKeyReused is returned when a key is sent again with a
+	// different request
+	ErrIdempotencyKeyReused = errors.New("idempotency key was used for a different request")
+	// ErrIdempotencyKeyInProgress is returned when the first request with
+	// the key hasn't finished yet
+	ErrIdempotencyKeyInProgress = errors.New("request with this idempotency key is in progress")
+)
+
+// IdempotencyService stores the responses of requests made with an
+// Idempotency-Key header so that retries get the original response
+// instead of repeating the action
+type IdempotencyService struct {
+	repo repository.Repository
+	ttl  atomic.Int64
+}
+
+// NewIdempotencyService creates a new idempotency service keeping
+// responses for ttl
+func NewIdempotencyService(repo repository.Repository, ttl time.Duration) *IdempotencyService {
+	s := &IdempotencyService{repo: repo}
+	s.ttl.Store(int64(ttl))
+	return s
+}
+
+// SetTTL changes how long new responses are kept
+func (s *IdempotencyService) SetTTL(ttl time.Duration) {
+	s.ttl.Store(int64(ttl))
+}
+
+// Begin claims the key for a request. It returns nil if the request should
+// be processed, or the stored record of a completed request with the same
+// key and hash, which should be replayed.
+func (s *IdempotencyService) Begin(ctx context.Context, userID int64, key, requestHash string) (*models.IdempotencyKey, error) {
+	record := &models.IdempotencyKey{
+		UserID:      userID,
+		Key:         key,
+		RequestHash: requestHash,
+		ExpiresAt:   time.Now().Add(time.Duration(s.ttl.Load())),
+	}
+	created, err := s.repo.CreateIdempotencyKey(ctx, record)
+	if err != nil || created {
+		return nil, err
+	}
+
+	existing, err := s.repo.GetIdempotencyKey(ctx, userID, key)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		// Released between the two queries; the client may retry
+		return nil, ErrIdempotencyKeyInProgress
+	}
+	if existing.RequestHash != requestHash {
+		return nil, ErrIdempotencyKeyReused
+	}
+	if existing.StatusCode == 0 {
+		return nil, ErrIdempotencyKeyInProgress
+	}
+	return existing, nil
+}
+
+// Complete stores the response of a request claimed with Begin
+func (s *IdempotencyService) Complete(ctx context.Context, record *models.IdempotencyKey) error {
+	return s.repo.CompleteIdempotencyKey(ctx, record)
+}
+
+// Release frees a key claimed with Begin without storing a response, so
+// that the request can be retried
+func (s *IdempotencyService) Release(ctx context.Context, userID int64, key string) error {
+	return s.repo.DeleteIdempotencyKey(ctx, userID, key)
+}
+
+// Prune deletes expired keys
+func (s *IdempotencyService) Prune(ctx context.Context) error {
+	deleted, err := s.repo.DeleteExpiredIdempotencyKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		logging.FromContext(ctx).Debug("Pruned expired idempotency keys", "count", deleted)
+	}
+	return nil
+}
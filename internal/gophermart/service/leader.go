@@ -0,0 +1,178 @@
+package service
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
+	"golang.org/x/exp/slog"
+)
+
+// LeaderJob is a background job that must run on a single replica
+type LeaderJob struct {
+	Name     string
+	Interval time.Duration
+	// Run is called every Interval while the replica is the leader. Its
+	// context is cancelled when leadership is lost.
+	Run func(ctx context.Context) error
+}
+
+// LeaderElector elects one replica to run singleton jobs. The leader is
+// whichever replica holds a Postgres advisory lock; the lock is released
+// when its session ends, so a crashed leader is replaced as soon as
+// Postgres notices the connection is gone.
+type LeaderElector struct {
+	lock          repository.AdvisoryLock
+	renewInterval time.Duration
+	jobs          []LeaderJob
+
+	leader atomic.Bool
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+
+	// cancelJobs stops the jobs of the current term, jobsWG waits for them
+	cancelJobs context.CancelFunc
+	jobsWG     sync.WaitGroup
+}
+
+// NewLeaderElector creates an elector for the named election. Replicas
+// using the same name compete for the same lock. Every renewInterval the
+// leader checks it still holds the lock and the others try to take it.
+func NewLeaderElector(repo repository.Repository, name string, renewInterval time.Duration) *LeaderElector {
+	return &LeaderElector{
+		lock:          repo.NewAdvisoryLock(lockKey(name)),
+		renewInterval: renewInterval,
+		stopCh:        make(chan struct{}),
+	}
+}
+
+// lockKey derives the advisory lock key from the election name
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("gophermart:" + name))
+	return int64(h.Sum64())
+}
+
+// Register adds a job. Jobs must be registered before Start.
+func (e *LeaderElector) Register(job LeaderJob) {
+	e.jobs = append(e.jobs, job)
+}
+
+// IsLeader reports whether this replica currently holds leadership
+func (e *LeaderElector) IsLeader() bool {
+	return e.leader.Load()
+}
+
+// Start starts campaigning for leadership
+func (e *LeaderElector) Start() {
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		e.campaign()
+	}()
+}
+
+// Stop stops the jobs and releases leadership so that another replica can
+// take over without waiting for the session to time out
+func (e *LeaderElector) Stop(ctx context.Context) error {
+	close(e.stopCh)
+	e.wg.Wait()
+
+	if !e.leader.Load() {
+		return nil
+	}
+	e.stepDown()
+	slog.Info("Released leadership")
+	return e.lock.Unlock(ctx)
+}
+
+// campaign tries to take the lock until it succeeds and then renews it
+// until it is lost or the elector is stopped
+func (e *LeaderElector) campaign() {
+	ticker := time.NewTicker(e.renewInterval)
+	defer ticker.Stop()
+
+	for {
+		e.renew()
+
+		select {
+		case <-ticker.C:
+		case <-e.stopCh:
+			return
+		}
+	}
+}
+
+// renew takes the lock if this replica is a follower, or checks that it is
+// still held if it is the leader
+func (e *LeaderElector) renew() {
+	ctx, cancel := context.WithTimeout(context.Background(), e.renewInterval)
+	defer cancel()
+
+	if !e.leader.Load() {
+		locked, err := e.lock.TryLock(ctx)
+		if err != nil {
+			slog.Error("Error acquiring leadership", "error", err)
+			return
+		}
+		if locked {
+			slog.Info("Acquired leadership")
+			e.stepUp()
+		}
+		return
+	}
+
+	held, err := e.lock.Held(ctx)
+	if err == nil && held {
+		return
+	}
+
+	// Another replica may take over now, so stop before anything else
+	slog.Error("Lost leadership", "error", err)
+	e.stepDown()
+	if err := e.lock.Unlock(ctx); err != nil {
+		slog.Error("Error releasing leadership", "error", err)
+	}
+}
+
+// stepUp starts the registered jobs
+func (e *LeaderElector) stepUp() {
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancelJobs = cancel
+	e.leader.Store(true)
+
+	for _, job := range e.jobs {
+		e.jobsWG.Add(1)
+		go func(job LeaderJob) {
+			defer e.jobsWG.Done()
+			runLeaderJob(ctx, job)
+		}(job)
+	}
+}
+
+// stepDown stops the jobs and waits for them to return
+func (e *LeaderElector) stepDown() {
+	e.leader.Store(false)
+	e.cancelJobs()
+	e.jobsWG.Wait()
+}
+
+// runLeaderJob runs the job every interval until ctx is cancelled
+func runLeaderJob(ctx context.Context, job LeaderJob) {
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := job.Run(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("Error running leader job", "job", job.Name, "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
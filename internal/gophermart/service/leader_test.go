@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
+)
+
+// testDatabaseURI returns the database used by tests that need Postgres,
+// skipping the test if none is configured
+func testDatabaseURI(t *testing.T) string {
+	t.Helper()
+	uri := os.Getenv("TEST_DATABASE_URI")
+	if uri == "" {
+		t.Skip("TEST_DATABASE_URI is not set")
+	}
+	return uri
+}
+
+func TestLeaderElectorBecomesLeader(t *testing.T) {
+	uri := testDatabaseURI(t)
+
+	// The elector is created before the database is opened, as in app.New
+	repo := repository.NewPostgresRepository(uri)
+	elector := NewLeaderElector(repo, "test-"+t.Name(), 50*time.Millisecond)
+	if err := repo.InitDB(uri); err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+
+	ran := make(chan struct{}, 1)
+	elector.Register(LeaderJob{
+		Name:     "test",
+		Interval: 50 * time.Millisecond,
+		Run: func(ctx context.Context) error {
+			select {
+			case ran <- struct{}{}:
+			default:
+			}
+			return nil
+		},
+	})
+	elector.Start()
+	defer elector.Stop(context.Background())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !elector.IsLeader() {
+		if time.Now().After(deadline) {
+			t.Fatal("elector did not become leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("leader job did not run")
+	}
+
+	// A second replica must not take over while the first holds the lock
+	other := NewLeaderElector(repo, "test-"+t.Name(), 50*time.Millisecond)
+	other.Start()
+	defer other.Stop(context.Background())
+	time.Sleep(200 * time.Millisecond)
+	if other.IsLeader() {
+		t.Fatal("second elector became leader while the first holds the lock")
+	}
+}
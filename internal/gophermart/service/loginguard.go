@@ -0,0 +1,229 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
+)
+
+// LockoutPolicy describes how failed login attempts are throttled
+type LockoutPolicy struct {
+	// FreeAttempts is the number of failures allowed without any delay
+	FreeAttempts int
+	// MaxFailures is the number of failures that triggers a lockout
+	MaxFailures int
+	// BaseDelay is the delay after the first failure past FreeAttempts,
+	// doubled on every following failure up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutDuration is how long the key stays locked after MaxFailures
+	LockoutDuration time.Duration
+	// FailureWindow is the period after which the failure counter restarts
+	FailureWindow time.Duration
+}
+
+// DefaultLoginPolicy returns the lockout policy applied per login
+func DefaultLoginPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		FreeAttempts:    3,
+		MaxFailures:     10,
+		BaseDelay:       1 * time.Second,
+		MaxDelay:        30 * time.Second,
+		LockoutDuration: 15 * time.Minute,
+		FailureWindow:   15 * time.Minute,
+	}
+}
+
+// DefaultTOTPPolicy returns the lockout policy applied per user to TOTP
+// checks made with an existing session, e.g. for withdrawals. A session is
+// all an attacker needs to guess there, so few failures are tolerated.
+func DefaultTOTPPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		FreeAttempts:    3,
+		MaxFailures:     5,
+		BaseDelay:       1 * time.Second,
+		MaxDelay:        30 * time.Second,
+		LockoutDuration: 15 * time.Minute,
+		FailureWindow:   15 * time.Minute,
+	}
+}
+
+// DefaultIPPolicy returns the lockout policy applied per client IP
+func DefaultIPPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		FreeAttempts:    20,
+		MaxFailures:     100,
+		BaseDelay:       1 * time.Second,
+		MaxDelay:        30 * time.Second,
+		LockoutDuration: 15 * time.Minute,
+		FailureWindow:   15 * time.Minute,
+	}
+}
+
+// delay returns how long the key must wait after the given number of failures
+func (p LockoutPolicy) delay(failures int) time.Duration {
+	if failures >= p.MaxFailures {
+		return p.LockoutDuration
+	}
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+
+	d := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// delays returns the delay after every number of failures from 1 to
+// MaxFailures, the last one being the lockout
+func (p LockoutPolicy) delays() []time.Duration {
+	delays := make([]time.Duration, p.MaxFailures)
+	for i := range delays {
+		delays[i] = p.delay(i + 1)
+	}
+	return delays
+}
+
+// LoginGuard protects login against password guessing. Its state is kept
+// in the repository, so it survives restarts and is shared across replicas.
+//
+// An attempt counts as failed from the moment it is admitted, and the
+// repository admits it and sets the delay for the next one in a single
+// statement. Concurrent guesses therefore can't all pass before the first
+// of them is recorded as failed. Attempts that turn out not to be guesses
+// are taken back with RecordSuccess or Release.
+type LoginGuard struct {
+	repo        repository.Repository
+	loginPolicy LockoutPolicy
+	ipPolicy    LockoutPolicy
+	totpPolicy  LockoutPolicy
+}
+
+// NewLoginGuard creates a new login guard
+func NewLoginGuard(repo repository.Repository, loginPolicy, ipPolicy, totpPolicy LockoutPolicy) *LoginGuard {
+	return &LoginGuard{
+		repo:        repo,
+		loginPolicy: loginPolicy,
+		ipPolicy:    ipPolicy,
+		totpPolicy:  totpPolicy,
+	}
+}
+
+// Attempt admits a login attempt and counts it as failed for both the
+// login and the IP. If the attempt is not allowed, it returns how long the
+// caller has to wait and nothing is counted.
+func (g *LoginGuard) Attempt(ctx context.Context, login, ip string) (time.Duration, error) {
+	retryAfter, err := g.claim(ctx, models.AttemptScopeIP, ip, g.ipPolicy)
+	if err != nil || retryAfter > 0 {
+		return retryAfter, err
+	}
+
+	retryAfter, err = g.claim(ctx, models.AttemptScopeLogin, login, g.loginPolicy)
+	if err != nil || retryAfter > 0 {
+		// The attempt isn't made, so it doesn't count for the IP either
+		if err := g.release(ctx, models.AttemptScopeIP, ip); err != nil {
+			logging.FromContext(ctx).Error("Error releasing login attempt", "scope", models.AttemptScopeIP, "error", err)
+		}
+	}
+	return retryAfter, err
+}
+
+// RecordSuccess clears failed attempts for the login and takes back the
+// successful attempt from the IP. The rest of the IP counter is kept so
+// that one valid account can't be used to reset it.
+func (g *LoginGuard) RecordSuccess(ctx context.Context, login, ip string) error {
+	if err := g.repo.ResetLoginAttempts(ctx, models.AttemptScopeLogin, login); err != nil {
+		return err
+	}
+
+	return g.release(ctx, models.AttemptScopeIP, ip)
+}
+
+// Release takes back an admitted attempt that was not a guess, e.g. a
+// right password sent without the second factor
+func (g *LoginGuard) Release(ctx context.Context, login, ip string) error {
+	if err := g.release(ctx, models.AttemptScopeLogin, login); err != nil {
+		return err
+	}
+
+	return g.release(ctx, models.AttemptScopeIP, ip)
+}
+
+// AttemptTOTP admits a TOTP check of the user made outside of login and
+// counts it as failed. If the check is not allowed, it returns how long
+// the user has to wait.
+func (g *LoginGuard) AttemptTOTP(ctx context.Context, userID int64) (time.Duration, error) {
+	return g.claim(ctx, models.AttemptScopeTOTP, strconv.FormatInt(userID, 10), g.totpPolicy)
+}
+
+// RecordTOTPSuccess clears the failed TOTP checks of the user
+func (g *LoginGuard) RecordTOTPSuccess(ctx context.Context, userID int64) error {
+	return g.repo.ResetLoginAttempts(ctx, models.AttemptScopeTOTP, strconv.FormatInt(userID, 10))
+}
+
+// ReleaseTOTP takes back an admitted TOTP check that was not a guess
+func (g *LoginGuard) ReleaseTOTP(ctx context.Context, userID int64) error {
+	return g.release(ctx, models.AttemptScopeTOTP, strconv.FormatInt(userID, 10))
+}
+
+func (g *LoginGuard) claim(ctx context.Context, scope, key string, policy LockoutPolicy) (time.Duration, error) {
+	if key == "" {
+		return 0, nil
+	}
+
+	now := time.Now()
+	attempt, ok, err := g.repo.ClaimLoginAttempt(ctx, scope, key, now.Add(-policy.FailureWindow), policy.delays())
+	if err != nil {
+		return 0, err
+	}
+
+	if !ok {
+		if attempt == nil || attempt.LockedUntil == nil || !now.Before(*attempt.LockedUntil) {
+			// The lock ran out right after the claim; a retry gets in
+			return time.Second, nil
+		}
+		return attempt.LockedUntil.Sub(now), nil
+	}
+
+	if attempt.Failures >= policy.MaxFailures {
+		logging.FromContext(ctx).Warn("Login locked after failed attempts", "scope", scope, "key", key, "lock", policy.LockoutDuration, "failures", attempt.Failures)
+	}
+	return 0, nil
+}
+
+func (g *LoginGuard) release(ctx context.Context, scope, key string) error {
+	if key == "" {
+		return nil
+	}
+
+	return g.repo.ReleaseLoginAttempt(ctx, scope, key)
+}
+
+// Prune deletes the attempts that no longer affect either policy: the
+// failure window has passed and the key isn't locked
+func (g *LoginGuard) Prune(ctx context.Context) error {
+	window := g.loginPolicy.FailureWindow
+	for _, policy := range []LockoutPolicy{g.ipPolicy, g.totpPolicy} {
+		if policy.FailureWindow > window {
+			window = policy.FailureWindow
+		}
+	}
+
+	deleted, err := g.repo.DeleteStaleLoginAttempts(ctx, time.Now().Add(-window))
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		logging.FromContext(ctx).Debug("Pruned stale login attempts", "count", deleted)
+	}
+	return nil
+}
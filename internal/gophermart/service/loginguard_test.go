@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
+)
+
+func TestLockoutPolicyDelays(t *testing.T) {
+	policy := LockoutPolicy{
+		FreeAttempts:    2,
+		MaxFailures:     6,
+		BaseDelay:       time.Second,
+		MaxDelay:        3 * time.Second,
+		LockoutDuration: time.Hour,
+	}
+	want := []time.Duration{0, 0, time.Second, 2 * time.Second, 3 * time.Second, time.Hour}
+
+	got := policy.delays()
+	if len(got) != len(want) {
+		t.Fatalf("got %d delays, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("delay after %d failures: got %s, want %s", i+1, got[i], want[i])
+		}
+	}
+}
+
+func TestLoginGuardConcurrentAttempts(t *testing.T) {
+	uri := testDatabaseURI(t)
+
+	repo := repository.NewPostgresRepository(uri)
+	if err := repo.InitDB(uri); err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	defer repo.Close()
+
+	policy := LockoutPolicy{
+		FreeAttempts:    3,
+		MaxFailures:     10,
+		BaseDelay:       time.Minute,
+		MaxDelay:        time.Minute,
+		LockoutDuration: time.Hour,
+		FailureWindow:   time.Hour,
+	}
+	guard := NewLoginGuard(repo, policy, policy, policy)
+	ctx := context.Background()
+	login := fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+	defer guard.RecordSuccess(ctx, login, "")
+
+	// The free attempts pass, then the one that sets the first delay; every
+	// other attempt made at the same time has to wait for it
+	var admitted atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			retryAfter, err := guard.Attempt(ctx, login, "")
+			if err != nil {
+				t.Errorf("Attempt: %v", err)
+				return
+			}
+			if retryAfter == 0 {
+				admitted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, want := admitted.Load(), int32(policy.FreeAttempts+1); got != want {
+		t.Fatalf("admitted %d concurrent attempts, want %d", got, want)
+	}
+
+	// A right password sent without the second factor doesn't count
+	if err := guard.Release(ctx, login, ""); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	attempt, err := repo.GetLoginAttempt(ctx, models.AttemptScopeLogin, login)
+	if err != nil {
+		t.Fatalf("GetLoginAttempt: %v", err)
+	}
+	if attempt.Failures != policy.FreeAttempts {
+		t.Fatalf("got %d failures after release, want %d", attempt.Failures, policy.FreeAttempts)
+	}
+}
@@ -0,0 +1,275 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/oauth2"
+)
+
+// OIDC errors
+var (
+	ErrInvalidOIDCState = errors.New("invalid or expired OIDC state")
+	ErrInvalidIDToken   = errors.New("invalid ID token")
+)
+
+const (
+	// oidcStateTTL limits how long a user may take to sign in at the provider
+	oidcStateTTL = 10 * time.Minute
+	// oidcTwoFactorTTL limits how long a user signed in at the provider may
+	// take to enter the second factor
+	oidcTwoFactorTTL = 5 * time.Minute
+	// oidcTwoFactorPurpose tells two-factor challenges from login states,
+	// which are signed with the same key
+	oidcTwoFactorPurpose = "oidc_2fa"
+	// oidcKeyLabel derives the key of the OIDC cookies from the JWT secret
+	oidcKeyLabel = "gophermart oidc cookies"
+)
+
+// OIDCConfig contains OpenID Connect client settings
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// oidcStateClaims is stored in a signed cookie between the redirect to the
+// provider and the callback
+type oidcStateClaims struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	jwt.RegisteredClaims
+}
+
+// oidcTwoFactorClaims is stored in a signed cookie between the callback and
+// the second factor of users with two-factor authentication
+type oidcTwoFactorClaims struct {
+	UserID  int64  `json:"user_id"`
+	Purpose string `json:"purpose"`
+	jwt.RegisteredClaims
+}
+
+// OIDCService implements the authorization code flow with PKCE against a
+// configurable OpenID Connect provider
+type OIDCService struct {
+	repo       repository.Repository
+	cfg        OIDCConfig
+	signingKey []byte
+
+	// The provider is discovered lazily so that an unavailable identity
+	// provider doesn't prevent the server from starting
+	mu       sync.Mutex
+	oauth2   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDCService creates a new OIDC service. The state and two-factor
+// cookies are signed with a key derived from signingKey rather than with
+// signingKey itself: that is the session token secret, and the cookies must
+// not pass for session tokens.
+func NewOIDCService(repo repository.Repository, cfg OIDCConfig, signingKey string) *OIDCService {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	}
+
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(oidcKeyLabel))
+
+	return &OIDCService{
+		repo:       repo,
+		cfg:        cfg,
+		signingKey: mac.Sum(nil),
+	}
+}
+
+// Begin returns the provider authorization URL and the signed state to be
+// stored in a cookie until the callback
+func (s *OIDCService) Begin() (string, string, error) {
+	oauth2Cfg, _, err := s.provider()
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := randomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	claims := oidcStateClaims{
+		State:    state,
+		Nonce:    nonce,
+		Verifier: verifier,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(oidcStateTTL)),
+		},
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.signingKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	authURL := oauth2Cfg.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	return authURL, signed, nil
+}
+
+// Finish exchanges the authorization code, verifies the ID token and returns
+// the linked user, creating one on first login
+func (s *OIDCService) Finish(ctx context.Context, code, state, signedState string) (*models.User, error) {
+	oauth2Cfg, verifier, err := s.provider()
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &oidcStateClaims{}
+	token, err := jwt.ParseWithClaims(signedState, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return s.signingKey, nil
+	})
+	if err != nil || !token.Valid || claims.State == "" || claims.State != state {
+		return nil, ErrInvalidOIDCState
+	}
+
+	oauth2Token, err := oauth2Cfg.Exchange(ctx, code, oauth2.VerifierOption(claims.Verifier))
+	if err != nil {
+		return nil, fmt.Errorf("exchange authorization code: %w", err)
+	}
+
+	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok {
+		return nil, ErrInvalidIDToken
+	}
+
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil || idToken.Nonce != claims.Nonce {
+		return nil, ErrInvalidIDToken
+	}
+
+	var profile struct {
+		PreferredUsername string `json:"preferred_username"`
+		Email             string `json:"email"`
+	}
+	if err := idToken.Claims(&profile); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	return s.linkUser(ctx, idToken.Issuer, idToken.Subject, profile.PreferredUsername, profile.Email)
+}
+
+// BeginTwoFactor returns a signed challenge to be stored in a cookie while
+// the user linked by Finish enters the second factor
+func (s *OIDCService) BeginTwoFactor(userID int64) (string, error) {
+	claims := oidcTwoFactorClaims{
+		UserID:  userID,
+		Purpose: oidcTwoFactorPurpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(oidcTwoFactorTTL)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.signingKey)
+}
+
+// FinishTwoFactor returns the ID of the user the challenge was issued for
+func (s *OIDCService) FinishTwoFactor(signedChallenge string) (int64, error) {
+	claims := &oidcTwoFactorClaims{}
+	token, err := jwt.ParseWithClaims(signedChallenge, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return s.signingKey, nil
+	})
+	if err != nil || !token.Valid || claims.Purpose != oidcTwoFactorPurpose || claims.UserID == 0 {
+		return 0, ErrInvalidOIDCState
+	}
+	return claims.UserID, nil
+}
+
+// linkUser returns the user linked to the external subject or creates one
+func (s *OIDCService) linkUser(ctx context.Context, issuer, subject, username, email string) (*models.User, error) {
+	user, err := s.repo.GetUserByExternalIdentity(ctx, issuer, subject)
+	if err != nil || user != nil {
+		return user, err
+	}
+
+	login, err := s.chooseLogin(ctx, issuer, subject, username, email)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, err := s.repo.CreateExternalUser(ctx, login, issuer, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.repo.GetUserByID(ctx, userID)
+}
+
+// chooseLogin picks a free login for a new external user, preferring the
+// names supplied by the provider
+func (s *OIDCService) chooseLogin(ctx context.Context, issuer, subject, username, email string) (string, error) {
+	for _, candidate := range []string{username, email} {
+		if candidate == "" {
+			continue
+		}
+
+		existing, err := s.repo.GetUserByLogin(ctx, candidate)
+		if err != nil {
+			return "", err
+		}
+		if existing == nil {
+			return candidate, nil
+		}
+	}
+
+	sum := sha256.Sum256([]byte(issuer + "|" + subject))
+	return "oidc-" + hex.EncodeToString(sum[:8]), nil
+}
+
+// provider discovers the identity provider on first use
+func (s *OIDCService) provider() (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.oauth2 != nil {
+		return s.oauth2, s.verifier, nil
+	}
+
+	// The provider keeps the context for later key set refreshes, so it
+	// must not be bound to the current request
+	providerCtx := oidc.ClientContext(context.Background(), &http.Client{Timeout: 10 * time.Second})
+	provider, err := oidc.NewProvider(providerCtx, s.cfg.Issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("discover OIDC provider: %w", err)
+	}
+
+	s.oauth2 = &oauth2.Config{
+		ClientID:     s.cfg.ClientID,
+		ClientSecret: s.cfg.ClientSecret,
+		RedirectURL:  s.cfg.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       s.cfg.Scopes,
+	}
+	s.verifier = provider.Verifier(&oidc.Config{ClientID: s.cfg.ClientID})
+
+	return s.oauth2, s.verifier, nil
+}
@@ -0,0 +1,390 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const testOIDCClientID = "gophermart"
+
+// mockIssuer is an OpenID Connect provider serving discovery, the key set
+// and the token endpoint. Authorization is done by the test itself with
+// authorize, as the browser would.
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	subject  string
+	username string
+
+	mu    sync.Mutex
+	codes map[string]mockAuthorization
+}
+
+// mockAuthorization is what the provider remembers about an issued code
+type mockAuthorization struct {
+	nonce     string
+	challenge string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	m := &mockIssuer{
+		key:      key,
+		subject:  "subject-1",
+		username: "alice",
+		codes:    map[string]mockAuthorization{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/jwks", m.jwks)
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+
+	return m
+}
+
+func (m *mockIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                m.URL,
+		"authorization_endpoint":                m.URL + "/authorize",
+		"token_endpoint":                        m.URL + "/token",
+		"jwks_uri":                              m.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (m *mockIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	encode := base64.RawURLEncoding.EncodeToString
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   encode(m.key.N.Bytes()),
+			"e":   encode(big.NewInt(int64(m.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	m.mu.Lock()
+	auth, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	// The verifier must hash to the challenge sent with the authorization
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != auth.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                m.URL,
+		"sub":                m.subject,
+		"aud":                testOIDCClientID,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"nonce":              auth.nonce,
+		"preferred_username": m.username,
+	})
+	idToken.Header["kid"] = "test"
+	signed, err := idToken.SignedString(m.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     signed,
+	})
+}
+
+// authorize plays the user signing in at the provider: it takes the
+// authorization URL and returns the code and state the provider redirects
+// back with
+func (m *mockIssuer) authorize(t *testing.T, authURL string) (string, string) {
+	t.Helper()
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("parse authorization URL: %v", err)
+	}
+	q := u.Query()
+	if q.Get("client_id") != testOIDCClientID || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization request %s", authURL)
+	}
+
+	code, err := randomHex(8)
+	if err != nil {
+		t.Fatalf("generate code: %v", err)
+	}
+	m.mu.Lock()
+	m.codes[code] = mockAuthorization{nonce: q.Get("nonce"), challenge: q.Get("code_challenge")}
+	m.mu.Unlock()
+
+	return code, q.Get("state")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// oidcUserRepo keeps the users and external identities the OIDC service
+// touches in memory
+type oidcUserRepo struct {
+	repository.Repository
+
+	mu         sync.Mutex
+	users      map[int64]*models.User
+	identities map[string]int64
+}
+
+func newOIDCUserRepo() *oidcUserRepo {
+	return &oidcUserRepo{
+		users:      map[int64]*models.User{},
+		identities: map[string]int64{},
+	}
+}
+
+func (r *oidcUserRepo) GetUserByID(ctx context.Context, id int64) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.users[id], nil
+}
+
+func (r *oidcUserRepo) GetUserByLogin(ctx context.Context, login string) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, user := range r.users {
+		if user.Login == login {
+			return user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *oidcUserRepo) GetUserByExternalIdentity(ctx context.Context, issuer, subject string) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id, ok := r.identities[issuer+"|"+subject]
+	if !ok {
+		return nil, nil
+	}
+	return r.users[id], nil
+}
+
+func (r *oidcUserRepo) CreateExternalUser(ctx context.Context, login, issuer, subject string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := int64(len(r.users) + 1)
+	r.users[id] = &models.User{ID: id, Login: login, Role: models.RoleUser}
+	r.identities[issuer+"|"+subject] = id
+	return id, nil
+}
+
+func newTestOIDCService(issuer *mockIssuer, repo repository.Repository) *OIDCService {
+	return NewOIDCService(repo, OIDCConfig{
+		Issuer:      issuer.URL,
+		ClientID:    testOIDCClientID,
+		RedirectURL: "http://localhost/api/user/oidc/callback",
+	}, "test-signing-key")
+}
+
+// login runs a whole login against the mock issuer
+func login(t *testing.T, s *OIDCService, issuer *mockIssuer) (*models.User, error) {
+	t.Helper()
+
+	authURL, signedState, err := s.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	code, state := issuer.authorize(t, authURL)
+	return s.Finish(context.Background(), code, state, signedState)
+}
+
+func TestOIDCFirstLoginCreatesUser(t *testing.T) {
+	issuer := newMockIssuer(t)
+	repo := newOIDCUserRepo()
+	s := newTestOIDCService(issuer, repo)
+
+	user, err := login(t, s, issuer)
+	if err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if user == nil || user.Login != issuer.username {
+		t.Fatalf("got user %+v, want a new user named %q", user, issuer.username)
+	}
+	if id := repo.identities[issuer.URL+"|"+issuer.subject]; id != user.ID {
+		t.Fatalf("identity linked to user %d, want %d", id, user.ID)
+	}
+}
+
+func TestOIDCReloginLinksExistingUser(t *testing.T) {
+	issuer := newMockIssuer(t)
+	repo := newOIDCUserRepo()
+	s := newTestOIDCService(issuer, repo)
+
+	first, err := login(t, s, issuer)
+	if err != nil {
+		t.Fatalf("first Finish: %v", err)
+	}
+
+	// The provider may report another name; the subject decides
+	issuer.username = "alice-renamed"
+	second, err := login(t, s, issuer)
+	if err != nil {
+		t.Fatalf("second Finish: %v", err)
+	}
+
+	if second.ID != first.ID {
+		t.Fatalf("re-login returned user %d, want %d", second.ID, first.ID)
+	}
+	if len(repo.users) != 1 {
+		t.Fatalf("got %d users, want 1", len(repo.users))
+	}
+}
+
+func TestOIDCFirstLoginAvoidsTakenLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	repo := newOIDCUserRepo()
+	repo.users[1] = &models.User{ID: 1, Login: issuer.username}
+	s := newTestOIDCService(issuer, repo)
+
+	user, err := login(t, s, issuer)
+	if err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if user.ID == 1 || user.Login == issuer.username {
+		t.Fatalf("external login took over the existing user %q", issuer.username)
+	}
+}
+
+func TestOIDCRejectsStateMismatch(t *testing.T) {
+	issuer := newMockIssuer(t)
+	repo := newOIDCUserRepo()
+	s := newTestOIDCService(issuer, repo)
+
+	authURL, signedState, err := s.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	code, _ := issuer.authorize(t, authURL)
+
+	_, err = s.Finish(context.Background(), code, "forged-state", signedState)
+	if !errors.Is(err, ErrInvalidOIDCState) {
+		t.Fatalf("got error %v, want ErrInvalidOIDCState", err)
+	}
+
+	// A state cookie signed with another key is rejected as well
+	other := NewOIDCService(repo, OIDCConfig{
+		Issuer:      issuer.URL,
+		ClientID:    testOIDCClientID,
+		RedirectURL: "http://localhost/api/user/oidc/callback",
+	}, "other-signing-key")
+	_, otherState, err := other.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	_, err = s.Finish(context.Background(), code, "forged-state", otherState)
+	if !errors.Is(err, ErrInvalidOIDCState) {
+		t.Fatalf("got error %v, want ErrInvalidOIDCState", err)
+	}
+
+	if len(repo.users) != 0 {
+		t.Fatalf("got %d users, want none", len(repo.users))
+	}
+}
+
+func TestOIDCRejectsPKCEMismatch(t *testing.T) {
+	issuer := newMockIssuer(t)
+	repo := newOIDCUserRepo()
+	s := newTestOIDCService(issuer, repo)
+
+	authURL, signedState, err := s.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	code, state := issuer.authorize(t, authURL)
+
+	// Keep the state and nonce but swap the verifier, as if the code had
+	// been intercepted and redeemed by someone without the original one
+	claims := &oidcStateClaims{}
+	if _, err := jwt.ParseWithClaims(signedState, claims, func(*jwt.Token) (interface{}, error) {
+		return s.signingKey, nil
+	}); err != nil {
+		t.Fatalf("parse state: %v", err)
+	}
+	claims.Verifier = "wrong-verifier-0123456789012345678901234567890123"
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.signingKey)
+	if err != nil {
+		t.Fatalf("sign state: %v", err)
+	}
+
+	user, err := s.Finish(context.Background(), code, state, forged)
+	if err == nil {
+		t.Fatalf("Finish accepted a code with the wrong verifier, got user %+v", user)
+	}
+	if len(repo.users) != 0 {
+		t.Fatalf("got %d users, want none", len(repo.users))
+	}
+}
+
+func TestOIDCTwoFactorChallenge(t *testing.T) {
+	issuer := newMockIssuer(t)
+	s := newTestOIDCService(issuer, newOIDCUserRepo())
+
+	challenge, err := s.BeginTwoFactor(42)
+	if err != nil {
+		t.Fatalf("BeginTwoFactor: %v", err)
+	}
+	userID, err := s.FinishTwoFactor(challenge)
+	if err != nil || userID != 42 {
+		t.Fatalf("FinishTwoFactor = %d, %v; want 42", userID, err)
+	}
+
+	// A login state cookie must not pass for a challenge
+	_, signedState, err := s.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if _, err := s.FinishTwoFactor(signedState); !errors.Is(err, ErrInvalidOIDCState) {
+		t.Fatalf("got error %v, want ErrInvalidOIDCState", err)
+	}
+}
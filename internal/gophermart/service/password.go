@@ -0,0 +1,198 @@
+package service
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password errors
+var (
+	ErrUnknownHashFormat = errors.New("unknown password hash format")
+	ErrPasswordTooShort  = errors.New("password is too short")
+	ErrPasswordRejected  = errors.New("password is too common")
+)
+
+// PasswordHasher hashes and verifies passwords
+type PasswordHasher interface {
+	// Hash returns the encoded hash of the password
+	Hash(password string) (string, error)
+	// Verify checks the password against the encoded hash and reports
+	// whether the hash should be replaced with a fresh one
+	Verify(password, encoded string) (ok bool, needsRehash bool, err error)
+}
+
+// Argon2idParams contains argon2id cost parameters
+type Argon2idParams struct {
+	Memory     uint32
+	Iterations uint32
+	Threads    uint8
+	SaltLength uint32
+	KeyLength  uint32
+}
+
+// DefaultArgon2idParams returns the recommended argon2id parameters
+func DefaultArgon2idParams() Argon2idParams {
+	return Argon2idParams{
+		Memory:     64 * 1024,
+		Iterations: 1,
+		Threads:    4,
+		SaltLength: 16,
+		KeyLength:  32,
+	}
+}
+
+// Argon2idHasher hashes passwords with argon2id in PHC string format.
+// Legacy bcrypt hashes are still accepted and reported for rehash.
+type Argon2idHasher struct {
+	params Argon2idParams
+}
+
+// NewArgon2idHasher creates a new argon2id hasher
+func NewArgon2idHasher(params Argon2idParams) *Argon2idHasher {
+	return &Argon2idHasher{params: params}
+}
+
+// Hash returns the PHC encoded argon2id hash of the password
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.params.Iterations, h.params.Memory, h.params.Threads, h.params.KeyLength)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.params.Memory, h.params.Iterations, h.params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify checks the password against an argon2id or bcrypt hash
+func (h *Argon2idHasher) Verify(password, encoded string) (bool, bool, error) {
+	switch {
+	case encoded == "":
+		// Users created through single sign-on have no password
+		return false, false, nil
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return h.verifyArgon2id(password, encoded)
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		return true, true, nil
+	default:
+		return false, false, ErrUnknownHashFormat
+	}
+}
+
+func (h *Argon2idHasher) verifyArgon2id(password, encoded string) (bool, bool, error) {
+	// $argon2id$v=19$m=65536,t=1,p=4$<salt>$<key>
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false, false, ErrUnknownHashFormat
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, false, ErrUnknownHashFormat
+	}
+
+	var params Argon2idParams
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Threads); err != nil {
+		return false, false, ErrUnknownHashFormat
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, ErrUnknownHashFormat
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false, ErrUnknownHashFormat
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Threads, params.KeyLength)
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return false, false, nil
+	}
+
+	return true, version != argon2.Version || params != h.params, nil
+}
+
+// PasswordPolicy validates new passwords
+type PasswordPolicy struct {
+	MinLength int
+	rejected  map[string]struct{}
+}
+
+// defaultRejectedPasswords is used when no rejected-passwords file is configured
+var defaultRejectedPasswords = []string{
+	"password", "password1", "12345678", "123456789", "1234567890",
+	"qwerty123", "qwertyuiop", "11111111", "iloveyou", "admin123",
+}
+
+// NewPasswordPolicy creates a password policy. Rejected passwords are read
+// from rejectedFile, one per line; the built-in list is used if it is empty.
+func NewPasswordPolicy(minLength int, rejectedFile string) (*PasswordPolicy, error) {
+	policy := &PasswordPolicy{
+		MinLength: minLength,
+		rejected:  make(map[string]struct{}),
+	}
+
+	if rejectedFile == "" {
+		for _, p := range defaultRejectedPasswords {
+			policy.rejected[p] = struct{}{}
+		}
+		return policy, nil
+	}
+
+	f, err := os.Open(rejectedFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if p := strings.TrimSpace(scanner.Text()); p != "" {
+			policy.rejected[strings.ToLower(p)] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// Validate checks the password against the policy
+func (p *PasswordPolicy) Validate(password string) error {
+	if len([]rune(password)) < p.MinLength {
+		return ErrPasswordTooShort
+	}
+
+	if _, ok := p.rejected[strings.ToLower(password)]; ok {
+		return ErrPasswordRejected
+	}
+
+	return nil
+}
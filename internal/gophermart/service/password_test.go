@@ -0,0 +1,85 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2idParams are cheap parameters that keep the tests fast
+func testArgon2idParams() Argon2idParams {
+	return Argon2idParams{Memory: 1024, Iterations: 1, Threads: 1, SaltLength: 16, KeyLength: 32}
+}
+
+func TestArgon2idHasherVerify(t *testing.T) {
+	hasher := NewArgon2idHasher(testArgon2idParams())
+
+	current, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+
+	other := testArgon2idParams()
+	other.Iterations = 2
+	outdated, err := NewArgon2idHasher(other).Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+
+	legacy, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		password   string
+		encoded    string
+		wantOK     bool
+		wantRehash bool
+		wantErr    error
+	}{
+		{name: "argon2id", password: "correct horse", encoded: current, wantOK: true},
+		{name: "argon2id wrong password", password: "wrong horse", encoded: current},
+		{name: "argon2id other parameters", password: "correct horse", encoded: outdated, wantOK: true, wantRehash: true},
+		{name: "argon2id other parameters wrong password", password: "wrong horse", encoded: outdated},
+		{name: "bcrypt", password: "correct horse", encoded: string(legacy), wantOK: true, wantRehash: true},
+		{name: "bcrypt wrong password", password: "wrong horse", encoded: string(legacy)},
+		{name: "no password", password: "", encoded: ""},
+		{name: "unknown format", password: "correct horse", encoded: "plain", wantErr: ErrUnknownHashFormat},
+		{name: "truncated argon2id", password: "correct horse", encoded: "$argon2id$v=19$m=1024,t=1,p=1$c2FsdA", wantErr: ErrUnknownHashFormat},
+		{name: "malformed parameters", password: "correct horse", encoded: "$argon2id$v=19$m=x,t=1,p=1$c2FsdA$a2V5", wantErr: ErrUnknownHashFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash, err := hasher.Verify(tt.password, tt.encoded)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if ok != tt.wantOK {
+				t.Fatalf("got ok %v, want %v", ok, tt.wantOK)
+			}
+			if rehash != tt.wantRehash {
+				t.Fatalf("got rehash %v, want %v", rehash, tt.wantRehash)
+			}
+		})
+	}
+}
+
+func TestArgon2idHasherSalts(t *testing.T) {
+	hasher := NewArgon2idHasher(testArgon2idParams())
+
+	a, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	b, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if a == b {
+		t.Fatal("two hashes of the same password are equal")
+	}
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
+)
+
+// memorySweepInterval is how often the in-memory store drops idle buckets
+const memorySweepInterval = time.Minute
+
+// RateLimit allows Limit requests per Period. Up to Limit requests may be
+// made at once; after that they are allowed at an even pace. A zero Limit
+// means no limit.
+type RateLimit struct {
+	Limit  int
+	Period time.Duration
+}
+
+// rate returns the refill rate in tokens per second
+func (l RateLimit) rate() float64 {
+	return float64(l.Limit) / l.Period.Seconds()
+}
+
+// RateLimitDecision is the outcome of a rate limited request
+type RateLimitDecision struct {
+	Allowed   bool
+	Limit     RateLimit
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the next request is allowed, zero if
+	// this one was
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps token buckets
+type RateLimitStore interface {
+	// Take takes a token from the bucket of the key, creating a full one if
+	// there is none
+	Take(ctx context.Context, key string, capacity, rate float64) (*models.TokenBucket, bool, error)
+	// Prune drops buckets unused for longer than idle; they would be full
+	Prune(ctx context.Context, idle time.Duration) error
+}
+
+// RateLimiter limits requests per route group with token buckets
+type RateLimiter struct {
+	store  RateLimitStore
+	limits atomic.Pointer[map[string]RateLimit]
+}
+
+// NewRateLimiter creates a rate limiter with limits per route group
+func NewRateLimiter(store RateLimitStore, limits map[string]RateLimit) *RateLimiter {
+	l := &RateLimiter{store: store}
+	l.SetLimits(limits)
+	return l
+}
+
+// SetLimits replaces the limits. Existing buckets keep their tokens.
+func (l *RateLimiter) SetLimits(limits map[string]RateLimit) {
+	l.limits.Store(&limits)
+}
+
+// Allow takes a token for the key in the route group. It returns nil if
+// the group has no limit.
+func (l *RateLimiter) Allow(ctx context.Context, group, key string) (*RateLimitDecision, error) {
+	limit := (*l.limits.Load())[group]
+	if limit.Limit <= 0 {
+		return nil, nil
+	}
+
+	capacity, rate := float64(limit.Limit), limit.rate()
+	bucket, allowed, err := l.store.Take(ctx, group+":"+key, capacity, rate)
+	if err != nil {
+		return nil, err
+	}
+
+	decision := &RateLimitDecision{
+		Allowed:   allowed,
+		Limit:     limit,
+		Remaining: int(bucket.Tokens),
+		Reset:     secondsToDuration((capacity - bucket.Tokens) / rate),
+	}
+	if !allowed {
+		decision.RetryAfter = secondsToDuration((1 - bucket.Tokens) / rate)
+	}
+	return decision, nil
+}
+
+// Prune drops the buckets that have been idle long enough to be full under
+// any of the limits
+func (l *RateLimiter) Prune(ctx context.Context) error {
+	var idle time.Duration
+	for _, limit := range *l.limits.Load() {
+		if limit.Period > idle {
+			idle = limit.Period
+		}
+	}
+	if idle == 0 {
+		return nil
+	}
+	return l.store.Prune(ctx, idle)
+}
+
+// secondsToDuration converts seconds to a duration, rounding up
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(math.Ceil(seconds * float64(time.Second)))
+}
+
+// memoryBucket is a bucket of the in-memory store
+type memoryBucket struct {
+	models.TokenBucket
+	capacity float64
+	rate     float64
+}
+
+// memoryRateLimitStore keeps buckets in memory, so limits apply per
+// replica
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+// NewMemoryRateLimitStore creates a store keeping buckets in memory
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{
+		buckets:   make(map[string]*memoryBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (s *memoryRateLimitStore) Take(ctx context.Context, key string, capacity, rate float64) (*models.TokenBucket, bool, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) > memorySweepInterval {
+		s.sweep(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{TokenBucket: models.TokenBucket{Tokens: capacity, UpdatedAt: now}}
+		s.buckets[key] = b
+	}
+	b.capacity, b.rate = capacity, rate
+
+	allowed := b.Take(capacity, rate, now)
+	bucket := b.TokenBucket
+	return &bucket, allowed, nil
+}
+
+// sweep drops the buckets that have refilled. The caller holds mu.
+func (s *memoryRateLimitStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if b.Tokens+now.Sub(b.UpdatedAt).Seconds()*b.rate >= b.capacity {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+// Prune is a no-op: the in-memory store sweeps itself
+func (s *memoryRateLimitStore) Prune(ctx context.Context, idle time.Duration) error {
+	return nil
+}
+
+// postgresRateLimitStore keeps buckets in the database, so limits are
+// shared by all replicas
+type postgresRateLimitStore struct {
+	repo repository.Repository
+}
+
+// NewPostgresRateLimitStore creates a store keeping buckets in the
+// database
+func NewPostgresRateLimitStore(repo repository.Repository) RateLimitStore {
+	return &postgresRateLimitStore{repo: repo}
+}
+
+func (s *postgresRateLimitStore) Take(ctx context.Context, key string, capacity, rate float64) (*models.TokenBucket, bool, error) {
+	return s.repo.TakeRateLimitToken(ctx, key, capacity, rate)
+}
+
+func (s *postgresRateLimitStore) Prune(ctx context.Context, idle time.Duration) error {
+	deleted, err := s.repo.DeleteIdleRateLimitBuckets(ctx, time.Now().Add(-idle))
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		logging.FromContext(ctx).Debug("Pruned idle rate limit buckets", "count", deleted)
+	}
+	return nil
+}
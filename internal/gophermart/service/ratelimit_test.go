@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := NewRateLimiter(NewMemoryRateLimitStore(), map[string]RateLimit{
+		"auth": {Limit: 3, Period: time.Minute},
+		"off":  {Limit: 0, Period: time.Minute},
+	})
+	ctx := context.Background()
+
+	// The burst of 3 is allowed, then one request every 20 seconds
+	for i, want := range []struct {
+		allowed   bool
+		remaining int
+	}{
+		{allowed: true, remaining: 2},
+		{allowed: true, remaining: 1},
+		{allowed: true, remaining: 0},
+		{allowed: false, remaining: 0},
+	} {
+		d, err := limiter.Allow(ctx, "auth", "10.0.0.1")
+		if err != nil {
+			t.Fatalf("request %d: Allow: %v", i, err)
+		}
+		if d.Allowed != want.allowed || d.Remaining != want.remaining {
+			t.Fatalf("request %d: got allowed %v remaining %d, want %v and %d", i, d.Allowed, d.Remaining, want.allowed, want.remaining)
+		}
+		if !d.Allowed && (d.RetryAfter <= 0 || d.RetryAfter > 20*time.Second) {
+			t.Fatalf("request %d: got Retry-After %s, want up to 20s", i, d.RetryAfter)
+		}
+		if d.Reset <= 0 || d.Reset > time.Minute {
+			t.Fatalf("request %d: got reset %s, want up to a minute", i, d.Reset)
+		}
+	}
+
+	// Buckets are per key
+	d, err := limiter.Allow(ctx, "auth", "10.0.0.2")
+	if err != nil {
+		t.Fatalf("Allow: %v", err)
+	}
+	if !d.Allowed {
+		t.Fatal("request of another key was limited")
+	}
+
+	// A zero limit and an unknown group mean no limit
+	for _, group := range []string{"off", "unknown"} {
+		d, err := limiter.Allow(ctx, group, "10.0.0.1")
+		if err != nil || d != nil {
+			t.Fatalf("group %s: got %+v, %v, want no decision", group, d, err)
+		}
+	}
+}
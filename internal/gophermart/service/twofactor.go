@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/utils"
+)
+
+// Two-factor authentication errors
+var (
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorNotStarted = errors.New("two-factor enrollment has not been started")
+	ErrInvalidTwoFactor    = errors.New("invalid two-factor code")
+	ErrTwoFactorRequired   = errors.New("two-factor code required")
+)
+
+const recoveryCodeCount = 10
+
+// TwoFactorService manages TOTP enrollment and verification
+type TwoFactorService struct {
+	repo   repository.Repository
+	issuer string
+}
+
+// NewTwoFactorService creates a new two-factor service
+func NewTwoFactorService(repo repository.Repository, issuer string) *TwoFactorService {
+	return &TwoFactorService{
+		repo:   repo,
+		issuer: issuer,
+	}
+}
+
+// Enroll generates a new pending TOTP secret and returns it with its otpauth URI
+func (s *TwoFactorService) Enroll(ctx context.Context, user *models.User) (string, string, error) {
+	if user.TOTPEnabled {
+		return "", "", ErrTwoFactorEnabled
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := s.repo.SetUserTOTPSecret(ctx, user.ID, secret); err != nil {
+		return "", "", err
+	}
+
+	return secret, utils.TOTPURI(s.issuer, user.Login, secret), nil
+}
+
+// Confirm enables two-factor authentication once the user proves possession
+// of the secret. It returns freshly generated recovery codes.
+func (s *TwoFactorService) Confirm(ctx context.Context, user *models.User, code string) ([]string, error) {
+	if user.TOTPEnabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotStarted
+	}
+
+	if err := s.verifyTOTP(ctx, user, code); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	if err := s.repo.EnableUserTOTP(ctx, user.ID, hashes); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Disable turns two-factor authentication off after verifying a code
+func (s *TwoFactorService) Disable(ctx context.Context, user *models.User, code, recoveryCode string) error {
+	if err := s.Verify(ctx, user, code, recoveryCode); err != nil {
+		return err
+	}
+
+	return s.repo.DisableUserTOTP(ctx, user.ID)
+}
+
+// Verify checks a TOTP code or, if it is empty, a recovery code. Every code
+// can be used only once. ErrTwoFactorRequired means neither was given,
+// which is a prompt for the code rather than a wrong guess.
+func (s *TwoFactorService) Verify(ctx context.Context, user *models.User, code, recoveryCode string) error {
+	if !user.TOTPEnabled {
+		return ErrTwoFactorNotEnabled
+	}
+
+	if code != "" {
+		return s.verifyTOTP(ctx, user, code)
+	}
+
+	if recoveryCode == "" {
+		return ErrTwoFactorRequired
+	}
+
+	ok, err := s.repo.UseRecoveryCode(ctx, user.ID, hashRecoveryCode(recoveryCode))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidTwoFactor
+	}
+
+	return nil
+}
+
+func (s *TwoFactorService) verifyTOTP(ctx context.Context, user *models.User, code string) error {
+	step, ok := utils.ValidateTOTP(user.TOTPSecret, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return ErrInvalidTwoFactor
+	}
+
+	// Reject replay of a code that has already been accepted
+	fresh, err := s.repo.UseTOTPStep(ctx, user.ID, step)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrInvalidTwoFactor
+	}
+
+	return nil
+}
+
+// generateRecoveryCode returns a random code formatted as xxxxx-xxxxx
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(b)
+	return code[:5] + "-" + code[5:], nil
+}
+
+// hashRecoveryCode hashes a recovery code for storage. Codes are random, so
+// a fast hash is enough.
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
@@ -2,31 +2,123 @@ package service
 
 import (
 	"context"
-	"log"
+	"errors"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/logging"
 	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/models"
 	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/repository"
+	"github.com/25x8/ya-prakt-6-sprint/internal/gophermart/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// pendingBatchSize is the number of pending orders processed per tick
+	pendingBatchSize = 100
+	// pendingQueryTimeout limits fetching a batch of pending orders
+	pendingQueryTimeout = 10 * time.Second
+	// orderDBTimeout is the time allowed for the status updates of an
+	// order on top of the accrual request timeout
+	orderDBTimeout = 5 * time.Second
 )
 
 // OrderProcessor processes orders in the background
 type OrderProcessor struct {
 	repo       repository.Repository
 	accrualSvc *AccrualService
-	interval   time.Duration
 	stopCh     chan struct{}
 	wg         sync.WaitGroup
+
+	// ctx is cancelled on Stop, aborting the orders being checked
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Interval and concurrency may be changed while running
+	interval    atomic.Int64
+	concurrency atomic.Int32
+	resetCh     chan struct{}
+
+	// lastTick is the time of the last batch fetched without error
+	lastTick atomic.Int64
+	// lastBatch is the number of pending orders in that batch
+	lastBatch atomic.Int32
+
+	// inFlight maps orders being checked to the time the check started
+	mu       sync.Mutex
+	inFlight map[string]time.Time
+}
+
+// InFlightOrder is an order the worker is checking right now
+type InFlightOrder struct {
+	Number    string    `json:"number"`
+	StartedAt time.Time `json:"started_at"`
 }
 
-// NewOrderProcessor creates a new order processor
-func NewOrderProcessor(repo repository.Repository, accrualSvc *AccrualService) *OrderProcessor {
-	return &OrderProcessor{
+// WorkerState is a snapshot of the order processor for diagnostics
+type WorkerState struct {
+	Interval    string          `json:"interval"`
+	Concurrency int             `json:"concurrency"`
+	LastTick    *time.Time      `json:"last_tick,omitempty"`
+	LastBatch   int             `json:"last_batch"`
+	InFlight    []InFlightOrder `json:"in_flight"`
+	Accrual     AccrualState    `json:"accrual"`
+}
+
+// NewOrderProcessor creates a new order processor that checks pending
+// orders every interval, up to concurrency orders at a time
+func NewOrderProcessor(repo repository.Repository, accrualSvc *AccrualService, interval time.Duration, concurrency int) *OrderProcessor {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &OrderProcessor{
+		ctx:        ctx,
+		cancel:     cancel,
 		repo:       repo,
 		accrualSvc: accrualSvc,
-		interval:   5 * time.Second, // Check for new orders every 5 seconds
 		stopCh:     make(chan struct{}),
+		resetCh:    make(chan struct{}, 1),
+		inFlight:   make(map[string]time.Time),
+	}
+	p.interval.Store(int64(interval))
+	p.concurrency.Store(int32(concurrency))
+	return p
+}
+
+// SetInterval changes the poll interval. The running loop picks it up
+// immediately.
+func (p *OrderProcessor) SetInterval(interval time.Duration) {
+	p.interval.Store(int64(interval))
+	select {
+	case p.resetCh <- struct{}{}:
+	default:
+	}
+}
+
+// SetConcurrency changes the number of orders processed at once, starting
+// with the next batch
+func (p *OrderProcessor) SetConcurrency(concurrency int) {
+	p.concurrency.Store(int32(concurrency))
+}
+
+func (p *OrderProcessor) getInterval() time.Duration {
+	return time.Duration(p.interval.Load())
+}
+
+// Interval returns the current poll interval
+func (p *OrderProcessor) Interval() time.Duration {
+	return p.getInterval()
+}
+
+// LastTick returns the time of the last successful poll, or the zero time
+// if there hasn't been one yet
+func (p *OrderProcessor) LastTick() time.Time {
+	if t := p.lastTick.Load(); t != 0 {
+		return time.Unix(0, t)
 	}
+	return time.Time{}
 }
 
 // Start starts the order processor
@@ -41,12 +133,39 @@ func (p *OrderProcessor) Start() {
 // Stop stops the order processor
 func (p *OrderProcessor) Stop() {
 	close(p.stopCh)
+	p.cancel()
 	p.wg.Wait()
 }
 
+// State returns a snapshot of the processor and the accrual client
+func (p *OrderProcessor) State() WorkerState {
+	state := WorkerState{
+		Interval:    p.getInterval().String(),
+		Concurrency: int(p.concurrency.Load()),
+		LastBatch:   int(p.lastBatch.Load()),
+		InFlight:    []InFlightOrder{},
+		Accrual:     p.accrualSvc.State(),
+	}
+	if lastTick := p.LastTick(); !lastTick.IsZero() {
+		state.LastTick = &lastTick
+	}
+
+	p.mu.Lock()
+	for number, startedAt := range p.inFlight {
+		state.InFlight = append(state.InFlight, InFlightOrder{Number: number, StartedAt: startedAt})
+	}
+	p.mu.Unlock()
+
+	sort.Slice(state.InFlight, func(i, j int) bool {
+		return state.InFlight[i].StartedAt.Before(state.InFlight[j].StartedAt)
+	})
+
+	return state
+}
+
 // processLoop is the main processing loop
 func (p *OrderProcessor) processLoop() {
-	ticker := time.NewTicker(p.interval)
+	ticker := time.NewTicker(p.getInterval())
 	defer ticker.Stop()
 
 	for {
@@ -54,21 +173,110 @@ func (p *OrderProcessor) processLoop() {
 		case <-ticker.C:
 			// Process pending orders
 			p.processPendingOrders()
+		case <-p.resetCh:
+			ticker.Reset(p.getInterval())
 		case <-p.stopCh:
 			return
 		}
 	}
 }
 
-// processPendingOrders processes all pending orders
+// processPendingOrders processes a batch of pending orders. Each order gets
+// its own deadline, so a batch may take longer than the poll interval; the
+// next tick waits for it.
 func (p *OrderProcessor) processPendingOrders() {
-	// In a real implementation, we would query for pending orders
-	// and process them in batches.
-	// For simplicity, this implementation is just a placeholder.
+	ctx, cancel := context.WithTimeout(p.ctx, pendingQueryTimeout)
+	defer cancel()
+
+	// The claim covers the whole batch, which is checked concurrency orders
+	// at a time, and is released once the batch is done
+	concurrency := int(p.concurrency.Load())
+	orderTimeout := p.accrualSvc.Timeout() + orderDBTimeout
+	rounds := (pendingBatchSize + concurrency - 1) / concurrency
+	lease := pendingQueryTimeout + time.Duration(rounds)*orderTimeout
+
+	ctx, span := tracing.Start(ctx, "worker.poll", trace.WithNewRoot())
+	orders, err := p.repo.ClaimPendingOrders(ctx, pendingBatchSize, lease)
+	span.SetAttributes(attribute.Int("orders.pending", len(orders)))
+	tracing.End(span, err)
+	if err != nil {
+		slog.Error("Error getting pending orders", "error", err)
+		return
+	}
+	p.lastTick.Store(time.Now().UnixNano())
+	p.lastBatch.Store(int32(len(orders)))
+	if len(orders) == 0 {
+		return
+	}
+	defer p.releaseClaims(orders)
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range orders {
+		select {
+		case <-p.stopCh:
+			wg.Wait()
+			return
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(order *models.Order) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			p.mu.Lock()
+			p.inFlight[order.Number] = time.Now()
+			p.mu.Unlock()
+			defer func() {
+				p.mu.Lock()
+				delete(p.inFlight, order.Number)
+				p.mu.Unlock()
+			}()
+
+			ctx, cancel := context.WithTimeout(p.ctx, orderTimeout)
+			defer cancel()
+			p.processOrder(ctx, order)
+		}(&orders[i])
+	}
+	wg.Wait()
 }
 
-// processOrder processes a single order
+// releaseClaims releases the claims of a batch, so that orders still
+// pending are checked again on the next tick, by this worker or another.
+// This also runs on Stop, hence the fresh context.
+func (p *OrderProcessor) releaseClaims(orders []models.Order) {
+	ctx, cancel := context.WithTimeout(context.Background(), pendingQueryTimeout)
+	defer cancel()
+
+	numbers := make([]string, len(orders))
+	for i, order := range orders {
+		numbers[i] = order.Number
+	}
+	if err := p.repo.ReleaseOrderClaims(ctx, numbers); err != nil {
+		slog.Error("Error releasing order claims", "error", err)
+	}
+}
+
+// processOrder processes a single order in its own trace, linked to the
+// request that uploaded it
 func (p *OrderProcessor) processOrder(ctx context.Context, order *models.Order) {
+	opts := []trace.SpanStartOption{
+		trace.WithNewRoot(),
+		trace.WithAttributes(attribute.String("order.number", order.Number)),
+	}
+	if link, ok := tracing.Link(order.TraceParent); ok {
+		opts = append(opts, trace.WithLinks(link))
+	}
+	ctx, span := tracing.Start(ctx, "worker.processOrder", opts...)
+	defer span.End()
+
+	logger := slog.Default().With("order", order.Number, "user_id", order.UserID)
+	if sc := span.SpanContext(); sc.IsValid() {
+		logger = logger.With("trace_id", sc.TraceID().String())
+	}
+	ctx = logging.NewContext(ctx, logger)
+
 	// Skip already processed orders
 	if order.Status == models.StatusProcessed || order.Status == models.StatusInvalid {
 		return
@@ -77,15 +285,21 @@ func (p *OrderProcessor) processOrder(ctx context.Context, order *models.Order)
 	// Update status to PROCESSING if it's NEW
 	if order.Status == models.StatusNew {
 		if err := p.repo.UpdateOrderStatus(ctx, order.Number, models.StatusProcessing, 0); err != nil {
-			log.Printf("Error updating order %s status: %v", order.Number, err)
+			logger.Error("Error updating order status", "error", err)
 			return
 		}
 	}
 
 	// Get accrual information
 	accrualResp, err := p.accrualSvc.GetOrderAccrual(ctx, order.Number)
+	if errors.Is(err, ErrAccrualRateLimited) || errors.Is(err, ErrAccrualCircuitOpen) {
+		// Already logged when the state changed; retried on a later tick
+		return
+	}
 	if err != nil {
-		log.Printf("Error getting accrual for order %s: %v", order.Number, err)
+		if ctx.Err() == nil {
+			logger.Error("Error getting accrual for order", "error", err)
+		}
 		return
 	}
 
@@ -96,6 +310,6 @@ func (p *OrderProcessor) processOrder(ctx context.Context, order *models.Order)
 
 	// Update order with final status
 	if err := p.repo.UpdateOrderStatus(ctx, order.Number, accrualResp.Status, accrualResp.Accrual); err != nil {
-		log.Printf("Error updating order %s with accrual: %v", order.Number, err)
+		logger.Error("Error updating order with accrual", "error", err)
 	}
 }
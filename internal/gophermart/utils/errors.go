@@ -0,0 +1,40 @@
+package utils
+
+import "strings"
+
+// joinedError is a list of errors reported as one
+type joinedError []error
+
+func (e joinedError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap lets errors.Is and errors.As look at every error on toolchains
+// that support multiple wrapped errors
+func (e joinedError) Unwrap() []error {
+	return e
+}
+
+// JoinErrors returns an error that reports all the non-nil errors, or nil
+// if there are none. A single error is returned as it is. It stands in for
+// errors.Join, which needs Go 1.20.
+func JoinErrors(errs ...error) error {
+	var joined joinedError
+	for _, err := range errs {
+		if err != nil {
+			joined = append(joined, err)
+		}
+	}
+
+	switch len(joined) {
+	case 0:
+		return nil
+	case 1:
+		return joined[0]
+	}
+	return joined
+}
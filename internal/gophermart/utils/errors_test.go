@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestJoinErrors(t *testing.T) {
+	first, second := errors.New("first"), errors.New("second")
+
+	tests := []struct {
+		name string
+		errs []error
+		want string
+	}{
+		{name: "none", errs: nil, want: ""},
+		{name: "only nil", errs: []error{nil, nil}, want: ""},
+		{name: "one", errs: []error{nil, first}, want: "first"},
+		{name: "several", errs: []error{first, nil, second}, want: "first; second"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := JoinErrors(tt.errs...)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("got %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of the RFC 6238 test vectors, base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestValidateTOTP(t *testing.T) {
+	// 081804 is the code of the RFC 6238 vector at 1111111109, step 37037036
+	at := time.Unix(1111111109, 0)
+	const step = 37037036
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		t        time.Time
+		want     bool
+		wantStep int64
+	}{
+		{name: "current step", secret: rfcSecret, code: "081804", t: at, want: true, wantStep: step},
+		{name: "previous step", secret: rfcSecret, code: "081804", t: at.Add(TOTPPeriod), want: true, wantStep: step},
+		{name: "next step", secret: rfcSecret, code: "081804", t: at.Add(-TOTPPeriod), want: true, wantStep: step},
+		{name: "two steps late", secret: rfcSecret, code: "081804", t: at.Add(2 * TOTPPeriod), want: false},
+		{name: "two steps early", secret: rfcSecret, code: "081804", t: at.Add(-2 * TOTPPeriod), want: false},
+		{name: "other vector", secret: rfcSecret, code: "005924", t: time.Unix(1234567890, 0), want: true, wantStep: 41152263},
+		{name: "wrong code", secret: rfcSecret, code: "081805", t: at, want: false},
+		{name: "short code", secret: rfcSecret, code: "81804", t: at, want: false},
+		{name: "eight digits", secret: rfcSecret, code: "07081804", t: at, want: false},
+		{name: "lowercase padded secret", secret: "gezdgnbvgy3tqojqgezdgnbvgy3tqojq====", code: "081804", t: at, want: true, wantStep: step},
+		{name: "invalid secret", secret: "not base32!", code: "081804", t: at, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, ok := ValidateTOTP(tt.secret, tt.code, tt.t)
+			if ok != tt.want {
+				t.Fatalf("got %v, want %v", ok, tt.want)
+			}
+			if ok && gotStep != tt.wantStep {
+				t.Fatalf("got step %d, want %d", gotStep, tt.wantStep)
+			}
+		})
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("GenerateTOTPSecret: %v", err)
+	}
+
+	now := time.Now()
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("secret %q is not base32: %v", secret, err)
+	}
+	if _, ok := ValidateTOTP(secret, totpCode(key, TOTPStep(now)), now); !ok {
+		t.Fatal("code of the generated secret was rejected")
+	}
+}